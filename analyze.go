@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Sampling limits for -analyze: at most analyzeSampleBytes are read from the
+// start of each file, and at most analyzeExtBudget per extension, so the
+// estimate stays quick on large sources.
+const (
+	analyzeSampleBytes = 256 << 10
+	analyzeExtBudget   = 16 << 20
+)
+
+// extensionStats aggregates the files of one extension.
+type extensionStats struct {
+	Ext        string
+	Files      int
+	Bytes      int64
+	Sampled    int64 // bytes fed to the compressor
+	Compressed int64 // compressed size of the sampled bytes
+}
+
+// ratio is the estimated compressed size as a fraction of the original, or
+// -1 if nothing was sampled.
+func (s extensionStats) ratio() float64 {
+	if s.Sampled == 0 {
+		return -1
+	}
+	return float64(s.Compressed) / float64(s.Sampled)
+}
+
+// analyzeSource groups the files that would be archived by extension and
+// estimates how well each group compresses by compressing a sample of every
+// file. The result is sorted by total size, largest first.
+func analyzeSource(cfg Config) ([]*extensionStats, error) {
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newSourceFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	levelName := cfg.CompressionLevel
+	if levelName == levelAuto {
+		levelName = "default"
+	}
+	level, err := encoderLevel(levelName)
+	if err != nil {
+		return nil, err
+	}
+	encoder, err := zstd.NewWriter(nil, append([]zstd.EOption{zstd.WithEncoderLevel(level)}, encoderMemoryOptions(cfg)...)...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd writer: %w", err)
+	}
+	defer encoder.Close()
+
+	byExt := map[string]*extensionStats{}
+	buf := make([]byte, analyzeSampleBytes)
+	err = walkSource(roots, filter, nil, func(p, name string, info os.FileInfo) error {
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		ext := fileExtension(path.Base(name))
+		stats := byExt[ext]
+		if stats == nil {
+			stats = &extensionStats{Ext: ext}
+			byExt[ext] = stats
+		}
+		stats.Files++
+		stats.Bytes += info.Size()
+		if stats.Sampled >= analyzeExtBudget || info.Size() == 0 {
+			return nil
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("could not open file '%s' for analysis: %w", p, err)
+		}
+		defer file.Close()
+		n, err := io.ReadFull(file, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("could not read file '%s' for analysis: %w", p, err)
+		}
+		stats.Sampled += int64(n)
+		stats.Compressed += int64(len(encoder.EncodeAll(buf[:n], nil)))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to analyze backups path '%s': %w", cfg.Source, err)
+	}
+
+	var result []*extensionStats
+	for _, stats := range byExt {
+		result = append(result, stats)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Bytes != result[j].Bytes {
+			return result[i].Bytes > result[j].Bytes
+		}
+		return result[i].Ext < result[j].Ext
+	})
+	return result, nil
+}
+
+// printAnalysis writes the -analyze table to w.
+func printAnalysis(w io.Writer, stats []*extensionStats) {
+	var total int64
+	for _, s := range stats {
+		total += s.Bytes
+	}
+	fmt.Fprintf(w, "%-12s %8s %12s %7s %9s\n", "EXTENSION", "FILES", "SIZE", "SHARE", "EST.RATIO")
+	for _, s := range stats {
+		ext := "." + s.Ext
+		if s.Ext == "" {
+			ext = "(none)"
+		}
+		share := 0.0
+		if total > 0 {
+			share = 100 * float64(s.Bytes) / float64(total)
+		}
+		ratio := "-"
+		if r := s.ratio(); r >= 0 {
+			ratio = fmt.Sprintf("%.0f%%", 100*r)
+		}
+		fmt.Fprintf(w, "%-12s %8d %12s %6.1f%% %9s\n", ext, s.Files, formatBytes(s.Bytes), share, ratio)
+	}
+}
+
+// runAnalyze prints the per-extension breakdown of the source and returns the
+// process exit code.
+func runAnalyze(cfg Config) int {
+	stats, err := analyzeSource(cfg)
+	if err != nil {
+		log.Printf("Error analyzing source: %v", err)
+		return exitFailure
+	}
+	printAnalysis(os.Stdout, stats)
+	return exitSuccess
+}
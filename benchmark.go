@@ -0,0 +1,249 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// benchmarkSampleBytes caps the part of the source -benchmark compresses. The
+// tar stream of the source is built in memory up to this size, so every codec
+// compresses exactly the same data and the disk does not skew the speeds.
+const benchmarkSampleBytes = 256 << 20
+
+// Preferences for the -benchmark recommendation.
+const (
+	preferRatio    = "ratio"    // the smallest archive
+	preferSpeed    = "speed"    // the fastest level
+	preferBalanced = "balanced" // the fastest level within benchmarkBalancedSlack of the smallest
+)
+
+// benchmarkBalancedSlack is how much larger than the smallest archive the
+// balanced recommendation may be, as a fraction.
+const benchmarkBalancedSlack = 0.05
+
+// gzipBenchmarkLevels are the gzip levels -benchmark compares with: fastest,
+// the default of the gzip command and best.
+var gzipBenchmarkLevels = []int{gzip.BestSpeed, 6, gzip.BestCompression}
+
+// errSampleFull stops the walk once the benchmark sample is complete.
+var errSampleFull = errors.New("sample full")
+
+// benchmarkResult is one row of the -benchmark table.
+type benchmarkResult struct {
+	Codec    string
+	Level    string
+	Size     int64
+	Duration time.Duration
+}
+
+// speed returns the throughput in input bytes per second.
+func (r benchmarkResult) speed(input int64) float64 {
+	return float64(input) / r.Duration.Seconds()
+}
+
+// benchmarkSample builds the tar stream a backup would compress, in memory
+// and cut off after benchmarkSampleLimit. It reports whether the whole source
+// fit.
+func benchmarkSample(cfg Config) ([]byte, bool, error) {
+	limit := benchmarkSampleLimit(cfg)
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return nil, false, err
+	}
+	filter, err := newSourceFilter(cfg)
+	if err != nil {
+		return nil, false, err
+	}
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	err = walkSource(roots, filter, nil, func(path, name string, info os.FileInfo) error {
+		if buf.Len() >= limit {
+			return errSampleFull
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = readLink(path); err != nil {
+				return fmt.Errorf("could not read symlink '%s': %w", path, err)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("could not create tar header for '%s': %w", path, err)
+		}
+		header.Name = name
+		if err := tarWriter.WriteHeader(header); err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		file, err := os.Open(path)
+		if err != nil {
+			return fmt.Errorf("could not open '%s': %w", path, err)
+		}
+		defer file.Close()
+		if _, err := io.CopyN(tarWriter, file, info.Size()); err != nil {
+			return fmt.Errorf("could not read '%s': %w", path, err)
+		}
+		return nil
+	})
+	if errors.Is(err, errSampleFull) {
+		return buf.Bytes(), false, nil
+	}
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to read backups path '%s': %w", cfg.Source, err)
+	}
+	if err := tarWriter.Close(); err != nil {
+		return nil, false, err
+	}
+	return buf.Bytes(), true, nil
+}
+
+// countingWriter counts the bytes written to it and discards them.
+type countingWriter struct{ n int64 }
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
+
+// benchmarkCompress compresses data with the compressor returned by open and
+// measures the output size and the time taken.
+func benchmarkCompress(data []byte, open func(w io.Writer) (io.WriteCloser, error)) (int64, time.Duration, error) {
+	var out countingWriter
+	start := time.Now()
+	w, err := open(&out)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := w.Write(data); err != nil {
+		return 0, 0, err
+	}
+	if err := w.Close(); err != nil {
+		return 0, 0, err
+	}
+	return out.n, time.Since(start), nil
+}
+
+// runBenchmarks compresses data with every zstd level and the gzip levels in
+// gzipBenchmarkLevels.
+func runBenchmarks(cfg Config, data []byte) ([]benchmarkResult, error) {
+	var results []benchmarkResult
+	for _, name := range []string{"fastest", "default", "better", "best"} {
+		level := compressionLevels[name]
+		size, took, err := benchmarkCompress(data, func(w io.Writer) (io.WriteCloser, error) {
+			return zstd.NewWriter(w, append([]zstd.EOption{zstd.WithEncoderLevel(level)}, encoderMemoryOptions(cfg)...)...)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("zstd level %s failed: %w", name, err)
+		}
+		results = append(results, benchmarkResult{Codec: "zstd", Level: name, Size: size, Duration: took})
+	}
+	for _, level := range gzipBenchmarkLevels {
+		size, took, err := benchmarkCompress(data, func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriterLevel(w, level)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("gzip level %d failed: %w", level, err)
+		}
+		results = append(results, benchmarkResult{Codec: "gzip", Level: fmt.Sprint(level), Size: size, Duration: took})
+	}
+	return results, nil
+}
+
+// recommendLevel picks the zstd level to use for the given preference.
+func recommendLevel(results []benchmarkResult, prefer string) (benchmarkResult, error) {
+	var zstdResults []benchmarkResult
+	for _, r := range results {
+		if r.Codec == "zstd" {
+			zstdResults = append(zstdResults, r)
+		}
+	}
+	if len(zstdResults) == 0 {
+		return benchmarkResult{}, fmt.Errorf("no zstd results")
+	}
+	smallest, fastest := zstdResults[0], zstdResults[0]
+	for _, r := range zstdResults {
+		if r.Size < smallest.Size {
+			smallest = r
+		}
+		if r.Duration < fastest.Duration {
+			fastest = r
+		}
+	}
+	switch prefer {
+	case preferRatio:
+		return smallest, nil
+	case preferSpeed:
+		return fastest, nil
+	case preferBalanced:
+		best := smallest
+		for _, r := range zstdResults {
+			if float64(r.Size) <= float64(smallest.Size)*(1+benchmarkBalancedSlack) && r.Duration < best.Duration {
+				best = r
+			}
+		}
+		return best, nil
+	default:
+		return benchmarkResult{}, fmt.Errorf("unknown -benchmark-prefer '%s', expected %s, %s or %s", prefer, preferRatio, preferSpeed, preferBalanced)
+	}
+}
+
+// printBenchmark writes the -benchmark table and the recommendation to w.
+func printBenchmark(w io.Writer, results []benchmarkResult, input int64, rec benchmarkResult, prefer string) {
+	fmt.Fprintf(w, "%-6s %-8s %12s %7s %12s\n", "CODEC", "LEVEL", "SIZE", "RATIO", "SPEED")
+	for _, r := range results {
+		fmt.Fprintf(w, "%-6s %-8s %12s %6.1f%% %10s/s\n", r.Codec, r.Level, formatBytes(r.Size),
+			100*float64(r.Size)/float64(input), formatBytes(int64(r.speed(input))))
+	}
+	fmt.Fprintf(w, "\nRecommended for -benchmark-prefer %s: -level %s (%s, %s/s)\n", prefer, rec.Level,
+		formatBytes(rec.Size), formatBytes(int64(rec.speed(input))))
+	for _, r := range results {
+		if r.Codec == "gzip" && r.Level == "6" {
+			fmt.Fprintf(w, "Compared with gzip -6 it is %.0f%% of the size at %.1fx the speed\n",
+				100*float64(rec.Size)/float64(r.Size), rec.speed(input)/r.speed(input))
+		}
+	}
+}
+
+// runBenchmark compresses the source with each codec and level and prints
+// the comparison, then returns the process exit code.
+func runBenchmark(cfg Config) int {
+	if _, err := recommendLevel([]benchmarkResult{{Codec: "zstd"}}, cfg.BenchmarkPrefer); err != nil {
+		log.Printf("Error: %v", err)
+		return exitFailure
+	}
+	data, complete, err := benchmarkSample(cfg)
+	if err != nil {
+		log.Printf("Error reading source: %v", err)
+		return exitFailure
+	}
+	if len(data) == 0 {
+		log.Printf("Error: the source holds nothing to compress")
+		return exitFailure
+	}
+	if !complete {
+		log.Printf("Source is larger than %s, benchmarking its first %s", formatBytes(int64(benchmarkSampleLimit(cfg))), formatBytes(int64(len(data))))
+	}
+	results, err := runBenchmarks(cfg, data)
+	if err != nil {
+		log.Printf("Error benchmarking: %v", err)
+		return exitFailure
+	}
+	rec, err := recommendLevel(results, cfg.BenchmarkPrefer)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return exitFailure
+	}
+	printBenchmark(os.Stdout, results, int64(len(data)), rec, cfg.BenchmarkPrefer)
+	return exitSuccess
+}
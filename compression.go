@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"runtime"
+	"slices"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressionLevels maps the -level names to zstd encoder levels.
+var compressionLevels = map[string]zstd.EncoderLevel{
+	"fastest": zstd.SpeedFastest,
+	"default": zstd.SpeedDefault,
+	"better":  zstd.SpeedBetterCompression,
+	"best":    zstd.SpeedBestCompression,
+}
+
+// levelAuto picks a level from the size of the source, see autoLevel.
+const levelAuto = "auto"
+
+// encoderLevel returns the zstd level for a -level name other than "auto".
+func encoderLevel(name string) (zstd.EncoderLevel, error) {
+	level, ok := compressionLevels[name]
+	if !ok {
+		return 0, fmt.Errorf("unknown compression level '%s', expected fastest, default, better, best or auto", name)
+	}
+	return level, nil
+}
+
+// autoLevel chooses a level by source size so a backup finishes in reasonable
+// time as the vault grows: best below -auto-level-small, fastest from
+// -auto-level-large on, and the balanced default level in between.
+func autoLevel(cfg Config, size sourceSize) string {
+	level := "default"
+	switch {
+	case size.Bytes < int64(cfg.AutoLevelSmall):
+		level = "best"
+	case size.Bytes >= int64(cfg.AutoLevelLarge):
+		level = "fastest"
+	}
+	log.Printf("Source holds %s, using compression level '%s'", formatBytes(size.Bytes), level)
+	return level
+}
+
+// levelOrder lists the -level names from the fastest to the best compression.
+var levelOrder = []string{"fastest", "default", "better", "best"}
+
+// adaptiveLevel implements -adaptive-compression: it lowers level while the
+// system is busy, so a backup on a shared host does not slow Vaultwarden down
+// at peak times. The load is the one minute load average divided by the
+// number of CPUs. Above -adaptive-load-low the level is lowered by one step,
+// from -adaptive-load-high on the fastest level is used, and otherwise level
+// is kept. If the load cannot be read, level is kept with a warning.
+func adaptiveLevel(cfg Config, level string) string {
+	load, err := loadAverage()
+	if err != nil {
+		log.Printf("Warning: -adaptive-compression: %v, using compression level '%s'", err, level)
+		return level
+	}
+	perCPU := load / float64(runtime.NumCPU())
+	adapted := level
+	switch i := slices.Index(levelOrder, level); {
+	case perCPU >= cfg.AdaptiveLoadHigh:
+		adapted = levelOrder[0]
+	case perCPU > cfg.AdaptiveLoadLow && i > 0:
+		adapted = levelOrder[i-1]
+	}
+	if adapted == level {
+		log.Printf("System load %.2f on %d CPUs (%.2f per CPU), using compression level '%s'", load, runtime.NumCPU(), perCPU, level)
+	} else {
+		log.Printf("System load %.2f on %d CPUs (%.2f per CPU), using compression level '%s' instead of '%s'", load, runtime.NumCPU(), perCPU, adapted, level)
+	}
+	return adapted
+}
+
+// checkRatio implements -min-ratio: a low ratio of the uncompressed size of
+// the files to the size of the archive usually means the source is mostly
+// data that is compressed already, such as images in attachments, and zstd
+// only costs CPU time.
+func checkRatio(cfg Config, arc *archive) error {
+	if cfg.MinRatio == 0 || arc.Size == 0 || arc.Bytes == 0 {
+		return nil
+	}
+	ratio := float64(arc.Bytes) / float64(arc.Size)
+	if ratio >= cfg.MinRatio {
+		return nil
+	}
+	msg := fmt.Sprintf("'%s' compressed %s to %s, a ratio of %.2f, below -min-ratio %.2f",
+		arc.Path, formatBytes(arc.Bytes), formatBytes(arc.Size), ratio, cfg.MinRatio)
+	if cfg.Strict {
+		return fmt.Errorf("%s (without -strict this is only a warning)", msg)
+	}
+	log.Printf("Warning: %s. The source may be mostly compressed data already; -level fastest gives about the same size for far less CPU, or -exclude the compressed files", msg)
+	return nil
+}
+
+// pzstdLevels maps the -level names to the numeric levels passed to pzstd,
+// chosen to match what the in-process encoder levels correspond to.
+var pzstdLevels = map[string]int{
+	"fastest": 1,
+	"default": 3,
+	"better":  7,
+	"best":    11,
+}
+
+// findPzstd resolves the -external-pzstd binary and checks that it runs.
+func findPzstd(name string) (string, error) {
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("pzstd binary '%s' not found: %w", name, err)
+	}
+	if out, err := exec.Command(path, "-V").CombinedOutput(); err != nil {
+		return "", fmt.Errorf("pzstd binary '%s' does not work: %w: %s", path, err, bytes.TrimSpace(out))
+	}
+	return path, nil
+}
+
+// externalCompressor compresses by piping everything written to it into a
+// pzstd process, whose output goes to the writer given to
+// newExternalCompressor.
+type externalCompressor struct {
+	cmd    *exec.Cmd
+	stdin  io.WriteCloser
+	stderr bytes.Buffer
+	waited bool
+	err    error
+}
+
+// newExternalCompressor starts pzstd at path with the level named level,
+// writing the compressed stream to w.
+func newExternalCompressor(path, level string, w io.Writer) (*externalCompressor, error) {
+	number, ok := pzstdLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown compression level '%s', expected fastest, default, better or best", level)
+	}
+	c := &externalCompressor{cmd: exec.Command(path, fmt.Sprintf("-%d", number), "-c")}
+	c.cmd.Stdout = w
+	c.cmd.Stderr = &c.stderr
+	stdin, err := c.cmd.StdinPipe()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to pzstd: %w", err)
+	}
+	c.stdin = stdin
+	if err := c.cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start pzstd '%s': %w", path, err)
+	}
+	return c, nil
+}
+
+// Write fails if pzstd exited early, with its error output when there is
+// any.
+func (c *externalCompressor) Write(p []byte) (int, error) {
+	n, err := c.stdin.Write(p)
+	if err != nil {
+		if waitErr := c.Close(); waitErr != nil {
+			return n, waitErr
+		}
+		return n, fmt.Errorf("failed to write to pzstd: %w", err)
+	}
+	return n, nil
+}
+
+// Close finishes the input and waits for pzstd to write the rest of its
+// output.
+func (c *externalCompressor) Close() error {
+	if c.waited {
+		return c.err
+	}
+	c.waited = true
+	c.stdin.Close()
+	if err := c.cmd.Wait(); err != nil {
+		c.err = fmt.Errorf("pzstd failed: %w: %s", err, bytes.TrimSpace(c.stderr.Bytes()))
+	}
+	return c.err
+}
+
+// kill stops pzstd if it is still running, when the backup fails before
+// the compressor was closed.
+func (c *externalCompressor) kill() {
+	if !c.waited {
+		c.cmd.Process.Kill()
+		c.Close()
+	}
+}
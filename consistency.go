@@ -0,0 +1,43 @@
+package main
+
+import (
+	"log"
+	"os"
+	"time"
+)
+
+// fileSnapshot is the size and modification time of a regular file when the
+// walk reached it, before its content was read.
+type fileSnapshot struct {
+	path    string
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// newFileSnapshot records the state of a file as the walk saw it.
+func newFileSnapshot(path, name string, info os.FileInfo) fileSnapshot {
+	return fileSnapshot{path: path, name: name, size: info.Size(), modTime: info.ModTime()}
+}
+
+// changedFiles stats every snapshotted file again and returns the archive
+// names of those whose size or modification time changed, or that are gone,
+// since the walk reached them. Their archived content may be a mix of the
+// old and the new data.
+func changedFiles(snapshots []fileSnapshot) []string {
+	var changed []string
+	for _, s := range snapshots {
+		info, err := os.Stat(s.path)
+		if err != nil {
+			log.Printf("Warning: '%s' changed during the backup: %v", logName(s.name), err)
+			changed = append(changed, s.name)
+			continue
+		}
+		if info.Size() != s.size || !info.ModTime().Equal(s.modTime) {
+			log.Printf("Warning: '%s' changed during the backup (size %d -> %d, modified %s -> %s), its archived content may be inconsistent",
+				logName(s.name), s.size, info.Size(), s.modTime.Format(time.RFC3339Nano), info.ModTime().Format(time.RFC3339Nano))
+			changed = append(changed, s.name)
+		}
+	}
+	return changed
+}
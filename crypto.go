@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"filippo.io/age"
+)
+
+// encryptedExtension is appended to the archive extension of encrypted
+// archives, giving mm-dd-yyyy-hash.tar.zstd.age.
+const encryptedExtension = ".age"
+
+// ageMagic starts every age encrypted file, used to detect encrypted archives
+// regardless of their name.
+const ageMagic = "age-encryption.org/v1"
+
+// Hash stages control whether the hash in the filename is computed over the
+// compressed archive before it is encrypted or over the encrypted file.
+const (
+	hashStagePreEncrypt  = "pre-encrypt"
+	hashStagePostEncrypt = "post-encrypt"
+)
+
+// loadPassphrase returns the encryption passphrase from the file given with
+// -passphrase-file, or from the VWBPASSPHRASE environment variable. An empty
+// result means archives are not encrypted.
+func loadPassphrase(path string) (string, error) {
+	if path == "" {
+		return os.Getenv("VWBPASSPHRASE"), nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase file '%s': %w", path, err)
+	}
+	passphrase := strings.TrimRight(string(data), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("passphrase file '%s' is empty", path)
+	}
+	return passphrase, nil
+}
+
+// checkHashStage validates a -hash-stage value.
+func checkHashStage(stage string) error {
+	if stage != hashStagePreEncrypt && stage != hashStagePostEncrypt {
+		return fmt.Errorf("unknown hash stage '%s', expected %s or %s", stage, hashStagePreEncrypt, hashStagePostEncrypt)
+	}
+	return nil
+}
+
+// newEncryptWriter returns a writer that encrypts everything written to it
+// into w with the passphrase. It must be closed to flush the final chunk.
+func newEncryptWriter(w io.Writer, passphrase string) (io.WriteCloser, error) {
+	recipient, err := age.NewScryptRecipient(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up encryption: %w", err)
+	}
+	encWriter, err := age.Encrypt(w, recipient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start encryption: %w", err)
+	}
+	return encWriter, nil
+}
+
+// newDecryptReader returns a reader of the decrypted contents of r if r is
+// age encrypted, or of r itself otherwise.
+func newDecryptReader(r io.Reader, passphrase string) (io.Reader, error) {
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(ageMagic))
+	if !bytes.Equal(magic, []byte(ageMagic)) {
+		return br, nil
+	}
+	if passphrase == "" {
+		return nil, fmt.Errorf("archive is encrypted, set -passphrase-file or VWBPASSPHRASE")
+	}
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to set up decryption: %w", err)
+	}
+	decReader, err := age.Decrypt(br, identity)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt archive: %w", err)
+	}
+	return decReader, nil
+}
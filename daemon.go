@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// runDaemon keeps the process running and backs up every cfg.Interval and,
+// with cfg.Watch, once the source has been quiet for cfg.Debounce after a
+// change. A backup is made right away on start. It returns the process exit
+// code once the process is asked to stop with SIGINT or SIGTERM, which
+// cancels the uploads of the backup in progress, if any, and waits for it to
+// finish.
+func runDaemon(cfg Config) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var changes <-chan struct{}
+	if cfg.Watch {
+		watcher, err := newSourceWatcher(cfg)
+		if err != nil {
+			log.Printf("Error watching source: %v", err)
+			return exitFailure
+		}
+		defer watcher.Close()
+		changes = watcher.changes
+	}
+	var ticks <-chan time.Time
+	if cfg.Interval > 0 {
+		ticker := time.NewTicker(cfg.Interval)
+		defer ticker.Stop()
+		ticks = ticker.C
+	}
+	log.Printf("Running as a daemon (interval %s, watch %t, debounce %s)", cfg.Interval, cfg.Watch, cfg.Debounce)
+	runOnce(ctx, cfg)
+
+	var debounce *time.Timer
+	var settled <-chan time.Time
+	for {
+		select {
+		case <-ctx.Done():
+			log.Println("Stopping daemon")
+			return exitSuccess
+		case <-ticks:
+			runOnce(ctx, cfg)
+		case <-changes:
+			// Every change restarts the quiet period.
+			if debounce == nil {
+				debounce = time.NewTimer(cfg.Debounce)
+			} else {
+				debounce.Reset(cfg.Debounce)
+			}
+			settled = debounce.C
+		case <-settled:
+			settled = nil
+			log.Printf("Source has been quiet for %s after a change", cfg.Debounce)
+			runOnce(ctx, cfg)
+		}
+	}
+}
+
+// sourceWatcher reports changes anywhere below the source directories. The
+// target directory and the files the tool writes itself are ignored, so a
+// target nested in the source does not trigger a backup after every backup.
+type sourceWatcher struct {
+	watcher *fsnotify.Watcher
+	ignore  []string
+	changes chan struct{}
+	limited bool
+	verbose bool
+}
+
+func newSourceWatcher(cfg Config) (*sourceWatcher, error) {
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create watcher: %w", err)
+	}
+	w := &sourceWatcher{watcher: watcher, changes: make(chan struct{}, 1), verbose: cfg.Verbose}
+	for _, path := range []string{cfg.Target, cfg.LockFile, cfg.ReportPath, cfg.ResultJSON, cfg.PromTextfile} {
+		if path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil {
+			w.ignore = append(w.ignore, abs)
+		}
+	}
+	for _, root := range roots {
+		w.addTree(root.Path)
+	}
+	go w.run()
+	return w, nil
+}
+
+// ignored reports whether path is, or is inside, an ignored path, or is one
+// of the temporary files writeFileAtomic writes an ignored file through.
+func (w *sourceWatcher) ignored(path string) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+	for _, ignore := range w.ignore {
+		if abs == ignore || strings.HasPrefix(abs, ignore+string(filepath.Separator)) {
+			return true
+		}
+		if strings.HasPrefix(abs, ignore+".") && strings.HasSuffix(abs, ".tmp") {
+			return true
+		}
+	}
+	return false
+}
+
+// addTree watches dir and every directory below it. Watches are a limited
+// resource on Linux (fs.inotify.max_user_watches); once the limit is hit the
+// rest of the tree is left unwatched with a warning, and changes there are
+// only picked up by -interval.
+func (w *sourceWatcher) addTree(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || !d.IsDir() {
+			return nil
+		}
+		if w.ignored(path) {
+			return filepath.SkipDir
+		}
+		if err := w.watcher.Add(path); err != nil {
+			if !w.limited {
+				w.limited = true
+				log.Printf("Warning: could not watch '%s': %v. Changes in unwatched directories are only backed up by -interval; on Linux raise fs.inotify.max_user_watches", path, err)
+			}
+			return filepath.SkipAll
+		}
+		return nil
+	})
+}
+
+func (w *sourceWatcher) run() {
+	for {
+		select {
+		case event, ok := <-w.watcher.Events:
+			if !ok {
+				return
+			}
+			if w.ignored(event.Name) {
+				continue
+			}
+			if event.Has(fsnotify.Create) {
+				if info, err := os.Lstat(event.Name); err == nil && info.IsDir() {
+					w.addTree(event.Name)
+				}
+			}
+			if w.verbose == true {
+				log.Printf("Change in source: %s %s", event.Op, logName(event.Name))
+			}
+			w.notify()
+		case err, ok := <-w.watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("Warning: watching source: %v", err)
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				w.notify()
+			}
+		}
+	}
+}
+
+// notify signals a change without blocking; one pending signal is enough.
+func (w *sourceWatcher) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops watching.
+func (w *sourceWatcher) Close() error {
+	return w.watcher.Close()
+}
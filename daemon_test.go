@@ -0,0 +1,36 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestSourceWatcherIgnoresOwnFiles(t *testing.T) {
+	source := t.TempDir()
+	cfg := testConfig(source, filepath.Join(source, "backups"))
+	cfg.ReportPath = filepath.Join(source, "report.json")
+	cfg.ResultJSON = filepath.Join(source, "result.json")
+	w, err := newSourceWatcher(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	tests := []struct {
+		path    string
+		ignored bool
+	}{
+		{filepath.Join(source, "backups", "01-02-2024-abcd1234.tar.zstd"), true},
+		{filepath.Join(source, "report.json"), true},
+		{filepath.Join(source, "result.json"), true},
+		{filepath.Join(source, "result.json.123456.tmp"), true},
+		{filepath.Join(source, "result.json.bak"), false},
+		{filepath.Join(source, "db.sqlite3"), false},
+		{filepath.Join(source, "backups-old", "db.sqlite3"), false},
+	}
+	for _, tt := range tests {
+		if got := w.ignored(tt.path); got != tt.ignored {
+			t.Errorf("ignored(%q) = %v, want %v", tt.path, got, tt.ignored)
+		}
+	}
+}
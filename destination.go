@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Destination is a remote location that archives are copied to once they have
+// been created in the target directory.
+type Destination interface {
+	// Name identifies the destination in logs and reports.
+	Name() string
+	// Store uploads size bytes read from r under key. Keys use forward
+	// slashes and are relative to the destination's own prefix.
+	Store(ctx context.Context, key string, r io.Reader, size int64) error
+	// Open streams the object stored under key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// errUploadFailed marks errors from the upload step, so the run can exit with
+// exitUploadFailure while the local archive is known to be good.
+var errUploadFailed = errors.New("upload failed")
+
+// UploadResult records the outcome of copying one file to one destination.
+// Attempted is false when the upload was skipped because an earlier one
+// failed with -fail-fast-on-upload.
+type UploadResult struct {
+	Destination string `json:"destination"`
+	Key         string `json:"key"`
+	Attempted   bool   `json:"attempted"`
+	Verified    bool   `json:"verified,omitempty"`
+	// ChecksumMismatch is set when S3 rejected the upload because the
+	// -s3-checksum of a part did not match the data it received.
+	ChecksumMismatch bool   `json:"checksum_mismatch,omitempty"`
+	Error            string `json:"error,omitempty"`
+}
+
+// openDestinations parses every -remote value. It is called before archiving
+// so a typo in a destination fails the run before any work is done.
+func openDestinations(ctx context.Context, cfg Config) ([]Destination, error) {
+	var dests []Destination
+	for _, spec := range cfg.Remotes {
+		dest, err := newDestination(ctx, cfg, spec)
+		if err != nil {
+			return nil, err
+		}
+		dests = append(dests, dest)
+	}
+	return dests, nil
+}
+
+// newDestination creates a Destination from an s3://bucket/prefix URL or a
+// local directory path.
+func newDestination(ctx context.Context, cfg Config, spec string) (Destination, error) {
+	if strings.HasPrefix(spec, "s3://") {
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote '%s': %w", spec, err)
+		}
+		if u.Host == "" {
+			return nil, fmt.Errorf("invalid remote '%s': missing bucket name", spec)
+		}
+		return newS3Destination(ctx, cfg, u.Host, u.Path)
+	}
+	if strings.Contains(spec, "://") {
+		return nil, fmt.Errorf("unsupported remote '%s': expected s3://bucket/prefix or a directory", spec)
+	}
+	return dirDestination{dir: spec}, nil
+}
+
+// uploadArchive copies the archive, and any sidecars written next to it, to
+// every destination. The object key is the rendered
+// -remote-prefix-template followed by the archive's filename.
+//
+// By default every upload is tried and failures are aggregated. With
+// cfg.FailFastOnUpload the first failure stops all remaining uploads, which
+// are still listed in the results but marked as not attempted. With
+// cfg.ParallelUploads each file is read once and streamed to all
+// destinations concurrently.
+func uploadArchive(ctx context.Context, cfg Config, dests []Destination, arc *archive) ([]UploadResult, error) {
+	tmpl, err := parsePrefixTemplate(cfg.RemotePrefixTemplate)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := renderPrefix(tmpl, arc.Fields)
+	if err != nil {
+		return nil, err
+	}
+	files := append([]string{arc.Path}, arc.Sidecars...)
+
+	var results []UploadResult
+	var failed int
+	record := func(dest Destination, key, path string, err error) {
+		result := uploadOutcome(ctx, cfg, dest, key, path, err)
+		if result.Error != "" {
+			failed++
+		}
+		results = append(results, result)
+	}
+	skip := func(dest Destination, key string) {
+		results = append(results, UploadResult{Destination: dest.Name(), Key: key})
+	}
+
+	if cfg.ParallelUploads && len(dests) > 1 {
+		for _, path := range files {
+			key := prefix + filepath.Base(path)
+			if failed > 0 && cfg.FailFastOnUpload {
+				for _, dest := range dests {
+					skip(dest, key)
+				}
+				continue
+			}
+			errs := storeFileFanOut(ctx, dests, key, path)
+			for i, dest := range dests {
+				record(dest, key, path, errs[i])
+			}
+		}
+	} else {
+		for _, dest := range dests {
+			for _, path := range files {
+				key := prefix + filepath.Base(path)
+				if failed > 0 && cfg.FailFastOnUpload {
+					skip(dest, key)
+					continue
+				}
+				record(dest, key, path, storeFile(ctx, dest, key, path))
+			}
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%w: %d of %d uploads failed", errUploadFailed, failed, len(results))
+	}
+	return results, nil
+}
+
+// uploadOutcome logs the result of storing path under key on dest and, with
+// cfg.VerifyRemote, verifies a successful upload.
+func uploadOutcome(ctx context.Context, cfg Config, dest Destination, key, path string, err error) UploadResult {
+	result := UploadResult{Destination: dest.Name(), Key: key, Attempted: true}
+	if err != nil {
+		log.Printf("Error uploading '%s' to %s: %v", key, dest.Name(), err)
+		result.Error = err.Error()
+		result.ChecksumMismatch = errors.Is(err, errChecksumMismatch)
+		return result
+	}
+	if !cfg.VerifyRemote {
+		log.Printf("Uploaded '%s' to %s", key, dest.Name())
+		return result
+	}
+	if err := verifyUpload(ctx, dest, key, path); err != nil {
+		log.Printf("Error verifying '%s' on %s: %v", key, dest.Name(), err)
+		result.Error = "verification failed: " + err.Error()
+		return result
+	}
+	result.Verified = true
+	log.Printf("Uploaded and verified '%s' on %s", key, dest.Name())
+	return result
+}
+
+// storeFile uploads the file at path to dest under key.
+func storeFile(ctx context.Context, dest Destination, key, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("could not open '%s' for upload: %w", path, err)
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("could not stat '%s' for upload: %w", path, err)
+	}
+	return dest.Store(ctx, key, file, info.Size())
+}
+
+// dirDestination copies archives into a local directory, typically another
+// mount such as a NAS share.
+type dirDestination struct {
+	dir string
+}
+
+func (d dirDestination) Name() string { return d.dir }
+
+func (d dirDestination) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	file, err := os.Open(filepath.Join(d.dir, filepath.FromSlash(key)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open '%s' in %s: %w", key, d.dir, err)
+	}
+	return file, nil
+}
+
+func (d dirDestination) Store(ctx context.Context, key string, r io.Reader, size int64) error {
+	finalPath := filepath.Join(d.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(finalPath), 0755); err != nil {
+		return fmt.Errorf("failed to create directory for '%s': %w", finalPath, err)
+	}
+	tempFile, err := os.CreateTemp(filepath.Dir(finalPath), "upload-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tempFile.Name()) // Clean up temp file on error
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, r); err != nil {
+		return fmt.Errorf("failed to copy to '%s': %w", finalPath, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close '%s': %w", tempFile.Name(), err)
+	}
+	if err := os.Rename(tempFile.Name(), finalPath); err != nil {
+		return fmt.Errorf("failed to rename temporary file to '%s': %w", finalPath, err)
+	}
+	return nil
+}
+
+// storeFileFanOut reads the file at path once and streams it to every
+// destination concurrently, returning one error per destination. Each
+// destination reads from its own io.Pipe, so the copy proceeds at the pace of
+// the slowest destination instead of buffering. A destination that fails is
+// dropped from the fan-out and the others carry on.
+func storeFileFanOut(ctx context.Context, dests []Destination, key, path string) []error {
+	errs := make([]error, len(dests))
+	file, err := os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("could not open '%s' for upload: %w", path, err)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		err = fmt.Errorf("could not stat '%s' for upload: %w", path, err)
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs
+	}
+
+	fan := &fanOutWriter{
+		writers: make([]*io.PipeWriter, len(dests)),
+		failed:  make([]bool, len(dests)),
+	}
+	var wg sync.WaitGroup
+	for i, dest := range dests {
+		pr, pw := io.Pipe()
+		fan.writers[i] = pw
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs[i] = dest.Store(ctx, key, pr, info.Size())
+			// Unblock the writer if Store returned without reading everything.
+			pr.CloseWithError(fmt.Errorf("upload to %s stopped", dest.Name()))
+		}()
+	}
+	_, copyErr := io.Copy(fan, file)
+	for _, pw := range fan.writers {
+		pw.CloseWithError(copyErr) // nil closes with io.EOF
+	}
+	wg.Wait()
+	if copyErr != nil {
+		for i := range errs {
+			if errs[i] == nil {
+				errs[i] = fmt.Errorf("could not read '%s' for upload: %w", path, copyErr)
+			}
+		}
+	}
+	return errs
+}
+
+// fanOutWriter writes to every pipe that has not failed yet. Unlike
+// io.MultiWriter, one failing pipe does not stop the others.
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	alive := 0
+	for i, w := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+		if _, err := w.Write(p); err != nil {
+			f.failed[i] = true
+			continue
+		}
+		alive++
+	}
+	if alive == 0 {
+		return 0, errors.New("every upload failed")
+	}
+	return len(p), nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "fmt"
+
+// deviceID is not implemented on this platform.
+func deviceID(path string) (uint64, error) {
+	return 0, fmt.Errorf("checking the device of a path is not supported on this platform")
+}
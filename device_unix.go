@@ -0,0 +1,17 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// deviceID returns the id of the device holding path.
+func deviceID(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return 0, fmt.Errorf("failed to stat '%s': %w", path, err)
+	}
+	return uint64(st.Dev), nil
+}
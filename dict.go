@@ -0,0 +1,237 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// dictDirName is the directory in the target that holds the dictionaries
+// trained by -auto-dict. Every dictionary ever used is kept, since an archive
+// can only be decompressed with the dictionary it was compressed with.
+const dictDirName = ".vwb-dicts"
+
+// dictExtension is the extension of dictionary files in dictDirName.
+const dictExtension = ".dict"
+
+// Limits of the source sample a dictionary is trained from. Every regular file
+// contributes up to dictSampleBytes from its start, until dictSampleBudget is
+// collected. The dictionary content is dictHistoryBytes, the size the zstd
+// command line trainer uses by default.
+const (
+	dictSampleBytes  = 16 << 10
+	dictSampleBudget = 8 << 20
+	dictHistoryBytes = 110 << 10
+)
+
+// decoderDicts are the dictionaries archives may have been compressed with,
+// loaded by loadDecoderDicts. Every zstd decoder is created with them.
+var decoderDicts [][]byte
+
+// decoderOptions returns the options for creating a zstd decoder.
+func decoderOptions() []zstd.DOption {
+	var opts []zstd.DOption
+	if len(decoderDicts) > 0 {
+		opts = append(opts, zstd.WithDecoderDicts(decoderDicts...))
+	}
+	if lowMemoryCodecs {
+		opts = append(opts, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+	}
+	return opts
+}
+
+// loadDecoderDicts loads the -dict dictionary and every dictionary trained by
+// -auto-dict in the target directory, or next to the archive being restored,
+// so archives compressed with any of them can be read.
+func loadDecoderDicts(cfg Config) error {
+	dirs := []string{cfg.Target}
+	if cfg.Restore.Archive != "" && filepath.Dir(cfg.Restore.Archive) != filepath.Clean(cfg.Target) {
+		dirs = append(dirs, filepath.Dir(cfg.Restore.Archive))
+	}
+	var paths []string
+	for _, dir := range dirs {
+		matches, err := filepath.Glob(filepath.Join(dir, dictDirName, "*"+dictExtension))
+		if err != nil {
+			return fmt.Errorf("failed to list dictionaries: %w", err)
+		}
+		paths = append(paths, matches...)
+	}
+	if cfg.Dict != "" {
+		paths = append(paths, cfg.Dict)
+	}
+	for _, p := range paths {
+		data, err := os.ReadFile(p)
+		if err != nil {
+			return fmt.Errorf("failed to read dictionary '%s': %w", p, err)
+		}
+		decoderDicts = append(decoderDicts, data)
+	}
+	return nil
+}
+
+// dictID returns the id a dictionary is stored under, or an error if data is
+// not a zstd dictionary.
+func dictID(data []byte) (uint32, error) {
+	if len(data) < 8 || binary.LittleEndian.Uint32(data) != 0xEC30A437 {
+		return 0, fmt.Errorf("not a zstd dictionary")
+	}
+	return binary.LittleEndian.Uint32(data[4:]), nil
+}
+
+// encoderDict returns the encoder option for compressing with the dictionary
+// at path and the id of the dictionary.
+func encoderDict(path string) (zstd.EOption, uint32, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read dictionary '%s': %w", path, err)
+	}
+	id, err := dictID(data)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid dictionary '%s': %w", path, err)
+	}
+	return zstd.WithEncoderDict(data), id, nil
+}
+
+// selectDict resolves the dictionary a backup is compressed with and returns
+// its path, or "" for none. With -auto-dict it is the newest dictionary in the
+// target directory. A new one is trained from the source if there is none
+// yet, or if the newest is older than -dict-retrain-interval. Training
+// failures only log a warning, the backup is then compressed without one.
+func selectDict(cfg Config) (string, error) {
+	if !cfg.AutoDict {
+		return cfg.Dict, nil
+	}
+	dir := filepath.Join(cfg.Target, dictDirName)
+	newest, modTime, err := newestDict(dir)
+	if err != nil {
+		return "", err
+	}
+	if newest != "" && (cfg.DictRetrainInterval <= 0 || time.Since(modTime) < cfg.DictRetrainInterval) {
+		return newest, nil
+	}
+	data, err := trainDict(cfg)
+	if err != nil {
+		log.Printf("Warning: could not train a compression dictionary: %v", err)
+		return newest, nil
+	}
+	id, _ := dictID(data)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create dictionary directory '%s': %w", dir, err)
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%08x%s", id, dictExtension))
+	if err := writeFileAtomic(path, data, 0644); err != nil {
+		return "", fmt.Errorf("failed to write dictionary '%s': %w", path, err)
+	}
+	decoderDicts = append(decoderDicts, data)
+	log.Printf("Trained new compression dictionary: %s", path)
+	return path, nil
+}
+
+// newestDict returns the most recently written dictionary in dir and its
+// modification time, or "" if there is none.
+func newestDict(dir string) (string, time.Time, error) {
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return "", time.Time{}, nil
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("failed to list dictionaries in '%s': %w", dir, err)
+	}
+	var newest string
+	var modTime time.Time
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), dictExtension) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		if newest == "" || info.ModTime().After(modTime) {
+			newest, modTime = filepath.Join(dir, entry.Name()), info.ModTime()
+		}
+	}
+	return newest, modTime, nil
+}
+
+// trainDict builds a dictionary from the start of the files that would be
+// archived. The dictionary content takes an equal share from every sample,
+// so it covers as many files as possible.
+func trainDict(cfg Config) ([]byte, error) {
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := newSourceFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	level, err := encoderLevel(cfg.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	var samples [][]byte
+	var total int
+	err = walkSource(roots, filter, nil, func(p, name string, info os.FileInfo) error {
+		if total >= dictSampleBudget || !info.Mode().IsRegular() || info.Size() == 0 {
+			return nil
+		}
+		file, err := os.Open(p)
+		if err != nil {
+			return fmt.Errorf("could not open '%s': %w", p, err)
+		}
+		defer file.Close()
+		sample, err := io.ReadAll(io.LimitReader(file, dictSampleBytes))
+		if err != nil {
+			return fmt.Errorf("could not read '%s': %w", p, err)
+		}
+		samples = append(samples, sample)
+		total += len(sample)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(samples) == 0 {
+		return nil, fmt.Errorf("the source has no files to sample")
+	}
+	share := dictHistoryBytes / len(samples)
+	if share < 64 {
+		share = 64
+	}
+	var history []byte
+	for _, sample := range samples {
+		if len(history) >= dictHistoryBytes {
+			break
+		}
+		history = append(history, sample[:min(share, len(sample), dictHistoryBytes-len(history))]...)
+	}
+	if len(history) < 8 {
+		return nil, fmt.Errorf("the source holds too little data to sample")
+	}
+	var b [4]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return nil, fmt.Errorf("failed to pick a dictionary id: %w", err)
+	}
+	// Ids below 32768 are reserved for registered dictionaries.
+	id := 32768 + binary.LittleEndian.Uint32(b[:])%(1<<32-32768)
+	data, err := zstd.BuildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: samples,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    level,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
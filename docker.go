@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// dockerBinary is the Docker command line client -restore-docker runs.
+const dockerBinary = "docker"
+
+// parseDockerTarget splits a -restore-docker value of the form
+// container:/path/in/container.
+func parseDockerTarget(spec string) (container, dir string, err error) {
+	container, dir, ok := strings.Cut(spec, ":")
+	if !ok || container == "" || !path.IsAbs(dir) {
+		return "", "", fmt.Errorf("invalid -restore-docker '%s', expected <container>:<absolute path>, e.g. vaultwarden:/data", spec)
+	}
+	return container, path.Clean(dir), nil
+}
+
+// dockerCommand runs the docker client with args and returns its output. On
+// failure the error includes what docker printed.
+func dockerCommand(docker string, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(docker, args...)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return "", fmt.Errorf("docker %s failed: %w: %s", args[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+// checkContainerStopped fails if the container does not exist, or if it is
+// running and force is not set: Vaultwarden keeps its database open, so
+// replacing the files under a running container corrupts them.
+func checkContainerStopped(docker, container string, force bool) error {
+	running, err := dockerCommand(docker, "inspect", "--type", "container", "--format", "{{.State.Running}}", container)
+	if err != nil {
+		return fmt.Errorf("container '%s' not found: %w", container, err)
+	}
+	if running != "true" {
+		return nil
+	}
+	msg := fmt.Sprintf("container '%s' is running, stop it first with 'docker stop %s'", container, container)
+	if force {
+		log.Printf("Warning: %s, restoring anyway because -force is set", msg)
+		return nil
+	}
+	return fmt.Errorf("%s (or use -force to restore into it while it runs)", msg)
+}
+
+// runRestoreDocker restores an archive into a Docker container: the archive
+// is extracted into a staging directory, the subdirectory of -restore-to if
+// given and the system temporary directory otherwise, and then copied into
+// the container with docker cp. It returns the process exit code.
+func runRestoreDocker(cfg Config) int {
+	container, dir, err := parseDockerTarget(cfg.RestoreDocker)
+	if err != nil {
+		log.Printf("Error: %v", err)
+		return exitFailure
+	}
+	docker, err := exec.LookPath(dockerBinary)
+	if err != nil {
+		log.Printf("Error: docker client not found: %v", err)
+		return exitFailure
+	}
+	log.Printf("--- Starting Restore of %s into container %s at %s ---", cfg.Restore.Archive, container, dir)
+
+	// 1. Check the container before extracting anything
+	if err := checkContainerStopped(docker, container, cfg.Force); err != nil {
+		log.Printf("Error restoring into container: %v", err)
+		log.Println("--- Restore failed. ---")
+		return exitFailure
+	}
+
+	// 2. Extract into a fresh staging directory
+	staging, err := os.MkdirTemp(cfg.Restore.To, "vwb-docker-restore-")
+	if err != nil {
+		log.Printf("Error creating staging directory: %v", err)
+		return exitFailure
+	}
+	defer os.RemoveAll(staging)
+	opts := cfg.Restore
+	opts.To = staging
+	opts.Policy = policyOverwrite
+	opts.Verbose = cfg.Verbose
+	opts.Progress = cfg.Progress
+	opts.Passphrase = cfg.Passphrase
+	opts.Force = cfg.Force
+	res := RestoreTarball(opts)
+	res.To = container + ":" + dir
+	log.Printf("Restore summary: %s", res)
+	if !res.Success {
+		writeRestoreReport(cfg, res)
+		log.Printf("Error restoring tarball: %s", res.Error)
+		log.Println("--- Restore failed. ---")
+		return res.ExitCode
+	}
+
+	// 3. Copy the content of the staging directory into the container. The
+	// trailing "/." makes docker cp copy what is in it, not the directory.
+	if _, err := dockerCommand(docker, "cp", staging+string(filepath.Separator)+".", container+":"+dir); err != nil {
+		res.Success, res.ExitCode, res.Error = false, exitFailure, err.Error()
+		writeRestoreReport(cfg, res)
+		log.Printf("Error copying into container: %v", err)
+		log.Println("--- Restore failed. ---")
+		return exitFailure
+	}
+	writeRestoreReport(cfg, res)
+	log.Printf("Restored files are in container %s at %s", container, dir)
+	log.Println("--- Restore completed successfully! ---")
+	return exitSuccess
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestParseDockerTarget(t *testing.T) {
+	tests := []struct {
+		spec      string
+		container string
+		dir       string
+		err       bool
+	}{
+		{spec: "vaultwarden:/data", container: "vaultwarden", dir: "/data"},
+		{spec: "vaultwarden:/data/", container: "vaultwarden", dir: "/data"},
+		{spec: "vw_1:/srv//vaultwarden/./data", container: "vw_1", dir: "/srv/vaultwarden/data"},
+		{spec: "vaultwarden:/", container: "vaultwarden", dir: "/"},
+		{spec: "vaultwarden", err: true},
+		{spec: "vaultwarden:", err: true},
+		{spec: "vaultwarden:data", err: true},
+		{spec: "vaultwarden:./data", err: true},
+		{spec: ":/data", err: true},
+		{spec: "", err: true},
+	}
+	for _, tt := range tests {
+		container, dir, err := parseDockerTarget(tt.spec)
+		if tt.err {
+			if err == nil {
+				t.Errorf("parseDockerTarget(%q) = %q, %q, want an error", tt.spec, container, dir)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseDockerTarget(%q) failed: %v", tt.spec, err)
+		} else if container != tt.container || dir != tt.dir {
+			t.Errorf("parseDockerTarget(%q) = %q, %q, want %q, %q", tt.spec, container, dir, tt.container, tt.dir)
+		}
+	}
+}
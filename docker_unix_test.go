@@ -0,0 +1,135 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeDocker is a docker client that logs every invocation to $DOCKER_LOG,
+// reports the container state in $DOCKER_STATE (running, stopped or missing)
+// to inspect and copies what cp is given into $DOCKER_CP_DIR.
+const fakeDocker = `#!/bin/sh
+echo "$@" >> "$DOCKER_LOG"
+case "$1" in
+inspect)
+	case "$DOCKER_STATE" in
+	running) echo true ;;
+	stopped) echo false ;;
+	*) echo "Error: No such container: $6" >&2; exit 1 ;;
+	esac ;;
+cp)
+	cp -R "$2" "$DOCKER_CP_DIR" ;;
+esac
+`
+
+// installFakeDocker puts fakeDocker first on PATH and returns the path of
+// its log.
+func installFakeDocker(t *testing.T, state string) string {
+	t.Helper()
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, dockerBinary), []byte(fakeDocker), 0755); err != nil {
+		t.Fatal(err)
+	}
+	logPath := filepath.Join(t.TempDir(), "docker.log")
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("DOCKER_LOG", logPath)
+	t.Setenv("DOCKER_STATE", state)
+	t.Setenv("DOCKER_CP_DIR", t.TempDir())
+	return logPath
+}
+
+// dockerCalls returns the invocations logged by fakeDocker, one per line.
+func dockerCalls(t *testing.T, logPath string) []string {
+	t.Helper()
+	data, err := os.ReadFile(logPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return strings.Split(strings.TrimSpace(string(data)), "\n")
+}
+
+func TestCheckContainerStopped(t *testing.T) {
+	tests := []struct {
+		state string
+		force bool
+		err   string
+	}{
+		{state: "stopped"},
+		{state: "running", err: "is running"},
+		{state: "running", force: true},
+		{state: "missing", err: "not found"},
+		{state: "missing", force: true, err: "not found"},
+	}
+	for _, tt := range tests {
+		logPath := installFakeDocker(t, tt.state)
+		err := checkContainerStopped(dockerBinary, "vaultwarden", tt.force)
+		if tt.err == "" && err != nil {
+			t.Errorf("%s container with force %v: %v", tt.state, tt.force, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s container with force %v: got error %v, want one containing %q", tt.state, tt.force, err, tt.err)
+		}
+		want := "inspect --type container --format {{.State.Running}} vaultwarden"
+		if calls := dockerCalls(t, logPath); len(calls) != 1 || calls[0] != want {
+			t.Errorf("docker was called as %q, want %q", calls, want)
+		}
+	}
+}
+
+func TestRunRestoreDocker(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"db.sqlite3": "database", "attachments/1/file.bin": "attachment"})
+	arc, err := createTarball(testConfig(source, t.TempDir()), sourceSize{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := testConfig(source, t.TempDir())
+	cfg.RestoreDocker = "vaultwarden:/data"
+	cfg.Restore.Archive = arc.Path
+	cfg.Restore.To = t.TempDir()
+
+	t.Run("running", func(t *testing.T) {
+		logPath := installFakeDocker(t, "running")
+		if code := runRestoreDocker(cfg); code != exitFailure {
+			t.Errorf("restore into a running container exited with %d, want %d", code, exitFailure)
+		}
+		for _, call := range dockerCalls(t, logPath) {
+			if strings.HasPrefix(call, "cp ") {
+				t.Errorf("files were copied into a running container: docker %s", call)
+			}
+		}
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		logPath := installFakeDocker(t, "stopped")
+		if code := runRestoreDocker(cfg); code != exitSuccess {
+			t.Fatalf("restore into a stopped container exited with %d", code)
+		}
+		calls := dockerCalls(t, logPath)
+		if len(calls) != 2 {
+			t.Fatalf("docker was called as %q, want inspect and cp", calls)
+		}
+		args := strings.Fields(calls[1])
+		staging := filepath.Join(cfg.Restore.To, "vwb-docker-restore-")
+		if len(args) != 3 || args[0] != "cp" || !strings.HasPrefix(args[1], staging) ||
+			!strings.HasSuffix(args[1], string(filepath.Separator)+".") || args[2] != "vaultwarden:/data" {
+			t.Errorf("docker was called as %q, want cp %s*/. vaultwarden:/data", calls[1], staging)
+		}
+		copied := os.Getenv("DOCKER_CP_DIR")
+		for name, want := range map[string]string{"db.sqlite3": "database", "attachments/1/file.bin": "attachment"} {
+			data, err := os.ReadFile(filepath.Join(copied, filepath.FromSlash(name)))
+			if err != nil || string(data) != want {
+				t.Errorf("copied %s = %q, %v, want %q", name, data, err, want)
+			}
+		}
+		if entries, _ := os.ReadDir(cfg.Restore.To); len(entries) != 0 {
+			t.Errorf("staging directory left behind in %s", cfg.Restore.To)
+		}
+	})
+}
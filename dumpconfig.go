@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"time"
+)
+
+// secretConfigFields are Config fields whose values are never printed: the
+// passphrase, webhook URLs, which carry their token in the path or query,
+// and the files holding the passphrase and the signing key. S3 credentials
+// come from the AWS SDK configuration and are never part of Config.
+var secretConfigFields = map[string]bool{
+	"Passphrase":     true,
+	"PassphraseFile": true,
+	"NotifyURL":      true,
+	"SignKey":        true,
+}
+
+// dumpConfig writes the effective configuration as indented JSON to w, after
+// defaults, flags and environment variables have all been applied. Secrets
+// are replaced with REDACTED and credentials are masked in URLs.
+func dumpConfig(w io.Writer, cfg Config) error {
+	data, err := json.MarshalIndent(configValues(reflect.ValueOf(cfg)), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode configuration: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// configValues converts a configuration struct into a map of printable
+// values, keyed by field name.
+func configValues(v reflect.Value) map[string]any {
+	values := map[string]any{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		values[field.Name] = configValue(field.Name, v.Field(i))
+	}
+	return values
+}
+
+func configValue(name string, v reflect.Value) any {
+	if secretConfigFields[name] {
+		if v.IsZero() {
+			return ""
+		}
+		return redacted
+	}
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case string:
+		return redactURL(value)
+	case stringList:
+		list := []string{}
+		for _, s := range value {
+			list = append(list, redactURL(s))
+		}
+		return list
+	}
+	if v.Kind() == reflect.Struct {
+		return configValues(v)
+	}
+	return v.Interface()
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// vaultwardenTmpPatterns are the transient files Vaultwarden and SQLite leave
+// in the data directory, excluded by -exclude-vw-tmp.
+var vaultwardenTmpPatterns = []string{
+	"*.tmp",
+	"*.sqlite3-journal",
+	"*.sqlite3-wal",
+	"*.sqlite3-shm",
+}
+
+// sourceFilter decides which paths under the source are left out of the
+// archive. It is shared by every walk of the source so that measuring,
+// archiving and inventories all see the same set of files.
+type sourceFilter struct {
+	excludes []string
+	// extensions, when not empty, is the set of lower case file extensions
+	// (without the dot) that are archived; all other files are left out.
+	extensions map[string]bool
+	// excludeHidden leaves out entries whose name starts with a dot.
+	excludeHidden bool
+	// followSymlinks makes walks archive what symlinks point to rather
+	// than the links themselves.
+	followSymlinks bool
+	// fastScan reads directories concurrently, see walkConcurrent.
+	fastScan bool
+	// oneFilesystem does not descend into directories on another file
+	// system than their parent, except those listed in followMounts, as
+	// paths relative to the source or absolute paths.
+	oneFilesystem bool
+	followMounts  []string
+	// skipSpecial leaves out FIFOs and device nodes, which are otherwise
+	// archived as entries without content. Sockets and other files tar has
+	// no entry type for are always left out.
+	skipSpecial bool
+	// ignoreErrors are the -ignore-errors-for patterns of files whose read
+	// errors do not fail the backup.
+	ignoreErrors []string
+	// modifiedAfter, when set, leaves out regular files modified after it,
+	// which may still be being written. It is -min-file-age before the
+	// filter was built.
+	modifiedAfter time.Time
+}
+
+// newSourceFilter builds the filter for cfg and validates its patterns.
+func newSourceFilter(cfg Config) (*sourceFilter, error) {
+	f := &sourceFilter{excludeHidden: !cfg.IncludeHidden, followSymlinks: cfg.FollowSymlinks, fastScan: cfg.FastScan, oneFilesystem: cfg.OneFilesystem, skipSpecial: cfg.SkipSpecial}
+	for _, mount := range cfg.FollowMounts {
+		if filepath.IsAbs(mount) {
+			f.followMounts = append(f.followMounts, filepath.Clean(mount))
+		} else {
+			f.followMounts = append(f.followMounts, strings.Trim(path.Clean(filepath.ToSlash(mount)), "/"))
+		}
+	}
+	if cfg.MinFileAge > 0 {
+		f.modifiedAfter = time.Now().Add(-cfg.MinFileAge)
+	}
+	patterns := append([]string{}, cfg.Excludes...)
+	if cfg.ExcludeVaultwardenTmp {
+		patterns = append(patterns, vaultwardenTmpPatterns...)
+	}
+	// Patterns are matched against slash separated names, so on Windows
+	// 'sends\*' means the same as 'sends/*'.
+	for _, pattern := range patterns {
+		pattern = filepath.ToSlash(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern '%s': %w", pattern, err)
+		}
+		f.excludes = append(f.excludes, pattern)
+	}
+	for _, pattern := range cfg.IgnoreErrorsFor {
+		pattern = filepath.ToSlash(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid -ignore-errors-for pattern '%s': %w", pattern, err)
+		}
+		f.ignoreErrors = append(f.ignoreErrors, pattern)
+	}
+	for _, ext := range cfg.OnlyExtensions {
+		if f.extensions == nil {
+			f.extensions = map[string]bool{}
+		}
+		f.extensions[strings.ToLower(strings.TrimPrefix(ext, "."))] = true
+	}
+	return f, nil
+}
+
+// skip reports whether the entry at relPath (slash separated, relative to the
+// source) should be left out. Patterns containing a slash are matched against
+// the whole relative path, other patterns against the base name only, so
+// "*.tmp" excludes temp files at any depth while "icon_cache/*" only matches
+// at the top level. Excluding a directory excludes everything below it.
+//
+// With an extension allowlist, files whose extension is not listed are left
+// out too. Directories are still walked to find matching files below them.
+// Files modified within -min-file-age are left out as well.
+func (f *sourceFilter) skip(relPath string, info os.FileInfo) bool {
+	base := path.Base(relPath)
+	if f.excludeHidden && strings.HasPrefix(base, ".") {
+		return true
+	}
+	if matchesAny(f.excludes, relPath) {
+		return true
+	}
+	if f.extensions != nil && !info.IsDir() {
+		if !f.extensions[fileExtension(base)] {
+			return true
+		}
+	}
+	return f.tooRecent(info)
+}
+
+// tooRecent reports whether info is a regular file modified within
+// -min-file-age.
+func (f *sourceFilter) tooRecent(info os.FileInfo) bool {
+	return !f.modifiedAfter.IsZero() && info.Mode().IsRegular() && info.ModTime().After(f.modifiedAfter)
+}
+
+// followMount reports whether the directory at relPath, on another file system
+// than its parent, is listed in -follow-mounts. abs is its absolute path.
+func (f *sourceFilter) followMount(relPath, abs string) bool {
+	for _, mount := range f.followMounts {
+		if mount == relPath || mount == abs {
+			return true
+		}
+	}
+	return false
+}
+
+// ignoreError reports whether a read error in the entry name matches
+// -ignore-errors-for and should not fail the backup.
+func (f *sourceFilter) ignoreError(name string) bool {
+	return matchesAny(f.ignoreErrors, name)
+}
+
+// matchesAny reports whether relPath matches one of patterns. Patterns
+// containing a slash are matched against the whole path, other patterns
+// against the base name only.
+func matchesAny(patterns []string, relPath string) bool {
+	for _, pattern := range patterns {
+		name := path.Base(relPath)
+		if strings.Contains(pattern, "/") {
+			name = relPath
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// fileExtension returns the lower case extension of a file name without the
+// dot, or "" if it has none.
+func fileExtension(name string) string {
+	return strings.ToLower(strings.TrimPrefix(path.Ext(name), "."))
+}
+
+// warnExcludedEnv warns when Vaultwarden's .env configuration file is left
+// out, typically by -include-hidden=false.
+func warnExcludedEnv(relPath string, info os.FileInfo) {
+	if path.Base(relPath) == ".env" && info.Mode().IsRegular() {
+		log.Printf("Warning: excluding '%s', the Vaultwarden configuration will be missing from the backup", logName(relPath))
+	}
+}
+
+// warnExcludedWAL warns when a non-empty SQLite write-ahead log is excluded.
+// Committed transactions that have not been checkpointed into the database
+// yet only exist in the WAL, so the archived database would be missing them.
+func warnExcludedWAL(relPath string, info os.FileInfo) {
+	if strings.HasSuffix(relPath, "-wal") && info.Mode().IsRegular() && info.Size() > 0 {
+		log.Printf("Warning: excluding non-empty SQLite WAL '%s', recent changes not yet checkpointed into the database will be missing from the backup", logName(relPath))
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package main
+
+import "fmt"
+
+// freeSpace is not implemented on this platform.
+func freeSpace(dir string) (uint64, error) {
+	return 0, fmt.Errorf("checking free space is not supported on this platform")
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"time"
+)
+
+// hashManifest is the JSON document written by -hash-manifest. Hash is a
+// digest over the names and hashes of all entries, so a single field tells
+// whether anything changed since a previous manifest.
+type hashManifest struct {
+	Source    string      `json:"source"`
+	Created   time.Time   `json:"created"`
+	Algorithm string      `json:"algorithm"`
+	Hash      string      `json:"hash"`
+	Files     int         `json:"files"`
+	Bytes     int64       `json:"bytes"`
+	Entries   []hashEntry `json:"entries"`
+}
+
+// hashEntry is one file in a hash manifest. The hash of a symlink is taken
+// over its target.
+type hashEntry struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Size int64  `json:"size"`
+	Hash string `json:"hash"`
+}
+
+// buildHashManifest hashes every file a backup with the current settings
+// would archive, with the -hash algorithm, without creating an archive.
+func buildHashManifest(cfg Config) (hashManifest, error) {
+	m := hashManifest{Source: cfg.Source, Created: time.Now(), Algorithm: cfg.HashAlgorithm, Entries: []hashEntry{}}
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return m, err
+	}
+	filter, err := newSourceFilter(cfg)
+	if err != nil {
+		return m, err
+	}
+	total, err := newNameHasher(cfg.HashAlgorithm)
+	if err != nil {
+		return m, err
+	}
+	err = walkSource(roots, filter, nil, func(path, name string, info os.FileInfo) error {
+		hasher, err := newNameHasher(cfg.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		entry := hashEntry{Name: name}
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			link, err := readLink(path)
+			if err != nil {
+				return fmt.Errorf("could not read symlink '%s': %w", path, err)
+			}
+			io.WriteString(hasher, link)
+			entry.Type = "symlink"
+		case info.Mode().IsRegular():
+			file, err := os.Open(path)
+			if err != nil {
+				return fmt.Errorf("could not open '%s': %w", path, err)
+			}
+			defer file.Close()
+			n, err := io.Copy(hasher, file)
+			if err != nil {
+				return fmt.Errorf("could not read '%s': %w", path, err)
+			}
+			entry.Type, entry.Size = "file", n
+			m.Files++
+			m.Bytes += n
+		default:
+			return nil
+		}
+		entry.Hash = hashDigest(hasher)
+		fmt.Fprintf(total, "%s\x00%s\n", entry.Name, entry.Hash)
+		m.Entries = append(m.Entries, entry)
+		return nil
+	})
+	if err != nil {
+		return m, fmt.Errorf("failed to hash backups path '%s': %w", cfg.Source, err)
+	}
+	m.Hash = hashDigest(total)
+	return m, nil
+}
+
+// runHashManifest writes the hash manifest of the source to -hash-manifest,
+// or stdout for "-", and returns the process exit code.
+func runHashManifest(cfg Config) int {
+	m, err := buildHashManifest(cfg)
+	if err != nil {
+		log.Printf("Error hashing source: %v", err)
+		return exitFailure
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding hash manifest: %v", err)
+		return exitFailure
+	}
+	data = append(data, '\n')
+	if cfg.HashManifest == "-" {
+		os.Stdout.Write(data)
+		return exitSuccess
+	}
+	if err := writeFileAtomic(cfg.HashManifest, data, 0644); err != nil {
+		log.Printf("Error writing hash manifest: %v", err)
+		return exitFailure
+	}
+	log.Printf("Wrote %s manifest of %d files (%s) to %s, overall hash %s", m.Algorithm, m.Files, formatBytes(m.Bytes), cfg.HashManifest, m.Hash)
+	return exitSuccess
+}
+
+// manifestChange is a file that was added, changed or removed between two
+// hash manifests. Size is the current size, OldSize the one in the stored
+// manifest.
+type manifestChange struct {
+	Status  string `json:"status"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Size    int64  `json:"size,omitempty"`
+	OldSize int64  `json:"old_size,omitempty"`
+}
+
+// manifestDiff is the output of -diff-manifest.
+type manifestDiff struct {
+	Since   time.Time        `json:"since"`
+	OldHash string           `json:"old_hash"`
+	Hash    string           `json:"hash"`
+	Added   int              `json:"added"`
+	Changed int              `json:"changed"`
+	Removed int              `json:"removed"`
+	Changes []manifestChange `json:"changes"`
+}
+
+// diffManifests compares the entries of two hash manifests of the same
+// algorithm. An entry whose hash or type differs counts as changed. The
+// changes are sorted by name.
+func diffManifests(old, current hashManifest) manifestDiff {
+	d := manifestDiff{Since: old.Created, OldHash: old.Hash, Hash: current.Hash, Changes: []manifestChange{}}
+	before := make(map[string]hashEntry, len(old.Entries))
+	for _, e := range old.Entries {
+		before[e.Name] = e
+	}
+	for _, e := range current.Entries {
+		prev, ok := before[e.Name]
+		delete(before, e.Name)
+		switch {
+		case !ok:
+			d.Added++
+			d.Changes = append(d.Changes, manifestChange{Status: "added", Name: e.Name, Type: e.Type, Size: e.Size})
+		case prev.Hash != e.Hash || prev.Type != e.Type:
+			d.Changed++
+			d.Changes = append(d.Changes, manifestChange{Status: "changed", Name: e.Name, Type: e.Type, Size: e.Size, OldSize: prev.Size})
+		}
+	}
+	for _, e := range before {
+		d.Removed++
+		d.Changes = append(d.Changes, manifestChange{Status: "removed", Name: e.Name, Type: e.Type, OldSize: e.Size})
+	}
+	sort.Slice(d.Changes, func(i, j int) bool { return d.Changes[i].Name < d.Changes[j].Name })
+	return d
+}
+
+// printManifestDiff writes the -diff-manifest table to w.
+func printManifestDiff(w io.Writer, d manifestDiff) {
+	if len(d.Changes) > 0 {
+		fmt.Fprintf(w, "%-8s %-8s %12s %12s  %s\n", "STATUS", "TYPE", "OLD SIZE", "SIZE", "NAME")
+	}
+	for _, c := range d.Changes {
+		oldSize, size := "-", "-"
+		if c.Status != "added" {
+			oldSize = formatBytes(c.OldSize)
+		}
+		if c.Status != "removed" {
+			size = formatBytes(c.Size)
+		}
+		fmt.Fprintf(w, "%-8s %-8s %12s %12s  %s\n", c.Status, c.Type, oldSize, size, c.Name)
+	}
+	fmt.Fprintf(w, "%d added, %d changed, %d removed since %s\n", d.Added, d.Changed, d.Removed, d.Since.Format(time.RFC3339))
+}
+
+// runDiffManifest compares the source with the hash manifest stored by an
+// earlier -hash-manifest and prints what was added, changed or removed since,
+// as a table or with -json as JSON. It returns the process exit code.
+func runDiffManifest(cfg Config) int {
+	data, err := os.ReadFile(cfg.DiffManifest)
+	if err != nil {
+		log.Printf("Error reading hash manifest: %v", err)
+		return exitFailure
+	}
+	var old hashManifest
+	if err := json.Unmarshal(data, &old); err != nil {
+		log.Printf("Error parsing hash manifest '%s': %v", cfg.DiffManifest, err)
+		return exitFailure
+	}
+	if old.Algorithm != cfg.HashAlgorithm {
+		log.Printf("Hashing with %s, the algorithm of '%s'", old.Algorithm, cfg.DiffManifest)
+		cfg.HashAlgorithm = old.Algorithm
+	}
+	current, err := buildHashManifest(cfg)
+	if err != nil {
+		log.Printf("Error hashing source: %v", err)
+		return exitFailure
+	}
+	d := diffManifests(old, current)
+	if !cfg.JSON {
+		printManifestDiff(os.Stdout, d)
+		return exitSuccess
+	}
+	out, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding changes: %v", err)
+		return exitFailure
+	}
+	os.Stdout.Write(append(out, '\n'))
+	return exitSuccess
+}
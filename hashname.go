@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Hash algorithms for the digest in archive filenames.
+const (
+	hashCRC32  = "crc32"  // 8 hex characters, the default
+	hashSHA256 = "sha256" // 64 hex characters
+	hashXXHash = "xxhash" // 16 hex characters, XXH64
+)
+
+// Limits for -hash-truncate. Below minHashTruncate names are not unique
+// enough to be useful; below warnHashTruncate a warning is logged, as two
+// archives of the same day get a fair chance of sharing a name.
+const (
+	minHashTruncate  = 4
+	warnHashTruncate = 8
+)
+
+// newNameHasher returns the hasher for a -hash value.
+func newNameHasher(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case hashCRC32:
+		return crc32.NewIEEE(), nil
+	case hashSHA256:
+		return sha256.New(), nil
+	case hashXXHash:
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown hash '%s', expected %s, %s or %s", algorithm, hashCRC32, hashSHA256, hashXXHash)
+	}
+}
+
+// checkHashOptions validates -hash and -hash-truncate.
+func checkHashOptions(algorithm string, truncate int) error {
+	hasher, err := newNameHasher(algorithm)
+	if err != nil {
+		return err
+	}
+	if truncate == 0 {
+		return nil
+	}
+	length := hasher.Size() * 2
+	if truncate < minHashTruncate || truncate > length {
+		return fmt.Errorf("invalid -hash-truncate %d, expected 0 or %d to %d for %s", truncate, minHashTruncate, length, algorithm)
+	}
+	if truncate < warnHashTruncate {
+		log.Printf("Warning: -hash-truncate %d keeps only %d bits of the hash in filenames, archives may end up with the same name", truncate, truncate*4)
+	}
+	return nil
+}
+
+// hashDigest returns the hex digest of hasher. CRC32 digests are formatted
+// without leading zeros, as they always have been.
+func hashDigest(hasher hash.Hash) string {
+	if h, ok := hasher.(hash.Hash32); ok {
+		return fmt.Sprintf("%x", h.Sum32())
+	}
+	return hex.EncodeToString(hasher.Sum(nil))
+}
+
+// digestMatches reports whether stored, the hash in an archive name or a
+// manifest, is digest or its start. A CRC32 compares by value as well, so one
+// written with leading zeros, as other tools print it, matches too.
+func digestMatches(algorithm, digest, stored string) bool {
+	if strings.HasPrefix(digest, stored) {
+		return true
+	}
+	if algorithm != hashCRC32 {
+		return false
+	}
+	want, err := strconv.ParseUint(stored, 16, 32)
+	if err != nil {
+		return false
+	}
+	got, err := strconv.ParseUint(digest, 16, 32)
+	return err == nil && got == want
+}
+
+// nameHash returns the part of digest used in the filename: the first
+// truncate hex characters, or all of it if truncate is 0.
+func nameHash(digest string, truncate int) string {
+	if truncate > 0 && truncate < len(digest) {
+		return digest[:truncate]
+	}
+	return digest
+}
+
+// storedDigest returns the full digest of the archive at path with algorithm,
+// over the same stream createTarball hashes: the file itself, or with stage
+// pre-encrypt the decrypted archive, which needs the passphrase.
+func storedDigest(path, algorithm, stage, passphrase string) (string, error) {
+	hasher, err := newNameHasher(algorithm)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open '%s' for hashing: %w", path, err)
+	}
+	defer file.Close()
+	var r io.Reader = file
+	if stage == hashStagePreEncrypt {
+		if r, err = newDecryptReader(file, passphrase); err != nil {
+			return "", err
+		}
+	}
+	if _, err := io.Copy(hasher, r); err != nil {
+		return "", fmt.Errorf("could not read '%s' for hashing: %w", path, err)
+	}
+	return hashDigest(hasher), nil
+}
+
+// checkNameCollision fails if an archive is already stored at path, where a
+// new archive with the full digest is about to be renamed to, and has a
+// different digest. Two archives of a day only share a name like that when
+// the hash in the name is too short to tell them apart, e.g. with a small
+// -hash-truncate, and the rename would silently replace the older one.
+func checkNameCollision(cfg Config, path, digest string) error {
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to stat existing archive '%s': %w", path, err)
+	}
+	existing, err := storedDigest(path, cfg.HashAlgorithm, cfg.HashStage, cfg.Passphrase)
+	if err != nil {
+		return err
+	}
+	if existing != digest {
+		return fmt.Errorf("'%s' already exists and holds a different archive (%s %s, the new one has %s), not replacing it; use a longer -hash-truncate", path, cfg.HashAlgorithm, existing, digest)
+	}
+	return nil
+}
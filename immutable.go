@@ -0,0 +1,29 @@
+package main
+
+import "log"
+
+// makeImmutable implements -restore-immutable: it protects the restored
+// files, and on platforms where that is possible the restored directories,
+// from being changed, so the state of a recovered vault is preserved while
+// it is investigated. Directories are protected after the files in them.
+// Every path that could not be protected is logged, and their names are
+// returned.
+func makeImmutable(files, dirs []string) []string {
+	paths := files
+	if immutableDirectories {
+		paths = append(append([]string{}, files...), dirs...)
+	}
+	var failed []string
+	for _, path := range paths {
+		if err := setImmutable(path); err != nil {
+			log.Printf("Warning: could not make '%s' immutable: %v", path, err)
+			failed = append(failed, path)
+		}
+	}
+	if len(failed) > 0 {
+		log.Printf("Warning: %d of %d restored paths could not be made immutable with %s", len(failed), len(paths), immutableMethod)
+		return failed
+	}
+	log.Printf("Made %d restored paths immutable with %s", len(paths), immutableMethod)
+	return nil
+}
@@ -0,0 +1,32 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// immutableMethod names how -restore-immutable protects files, for the log.
+const immutableMethod = "the user immutable flag (chflags uchg)"
+
+// immutableDirectories reports whether setImmutable also protects
+// directories.
+const immutableDirectories = true
+
+// userImmutableFlag is UF_IMMUTABLE from sys/stat.h.
+const userImmutableFlag = 0x00000002
+
+// setImmutable sets the user immutable flag of path, like chflags uchg. The
+// owner of the file can clear it again with chflags nouchg.
+func setImmutable(path string) error {
+	var st unix.Stat_t
+	if err := unix.Lstat(path, &st); err != nil {
+		return fmt.Errorf("failed to stat: %w", err)
+	}
+	if err := unix.Chflags(path, int(st.Flags)|userImmutableFlag); err != nil {
+		return fmt.Errorf("failed to set immutable flag: %w", err)
+	}
+	return nil
+}
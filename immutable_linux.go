@@ -0,0 +1,39 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// immutableMethod names how -restore-immutable protects files, for the log.
+const immutableMethod = "the immutable attribute (chattr +i)"
+
+// immutableDirectories reports whether setImmutable also protects
+// directories.
+const immutableDirectories = true
+
+// fsImmutableFlag is FS_IMMUTABLE_FL from linux/fs.h.
+const fsImmutableFlag = 0x00000010
+
+// setImmutable sets the immutable attribute of path, like chattr +i. It needs
+// CAP_LINUX_IMMUTABLE, in practice root, and a file system that supports it,
+// such as ext4, xfs or btrfs.
+func setImmutable(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	flags, err := unix.IoctlGetUint32(int(file.Fd()), unix.FS_IOC_GETFLAGS)
+	if err != nil {
+		return fmt.Errorf("failed to read attributes: %w", err)
+	}
+	if err := unix.IoctlSetPointerInt(int(file.Fd()), unix.FS_IOC_SETFLAGS, int(flags|fsImmutableFlag)); err != nil {
+		return fmt.Errorf("failed to set immutable attribute: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "os"
+
+// immutableMethod names how -restore-immutable protects files, for the log.
+const immutableMethod = "the read-only attribute"
+
+// immutableDirectories reports whether setImmutable also protects
+// directories. The read-only attribute does not stop changes to the content
+// of a directory, so they are left alone.
+const immutableDirectories = false
+
+// setImmutable makes path read-only. On Windows this sets its read-only
+// attribute, which attrib -r clears again.
+func setImmutable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(path, info.Mode().Perm()&^0222)
+}
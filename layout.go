@@ -0,0 +1,102 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// latestLinkName is the symlink in the target directory that -latest-link
+// keeps pointed at the newest archive.
+const latestLinkName = "latest"
+
+// labeledDirName is the subdirectory of the target that -organize-labeled
+// stores labeled archives in, one directory per label.
+const labeledDirName = "labeled"
+
+// archiveDir returns the directory an archive with the given name fields is
+// stored in: the target directory itself, or its yyyy/mm subdirectory with
+// -organize. With -organize-labeled, labeled archives go into
+// labeled/<label> instead.
+func archiveDir(cfg Config, fields nameFields) string {
+	if cfg.OrganizeLabeled && fields.Label != "" {
+		return filepath.Join(cfg.Target, labeledDirName, fields.Label)
+	}
+	if cfg.Organize {
+		return filepath.Join(cfg.Target, fields.Year, fields.Month)
+	}
+	return cfg.Target
+}
+
+// updateLatestLink points the latest symlink in the target directory at the
+// newest archive there, or removes it if no archive is left. The link is
+// relative, so it stays valid when the target is mounted elsewhere, and is
+// replaced atomically so readers never find it missing. Archives in trash
+// are not considered.
+func updateLatestLink(target, trash string) error {
+	link := filepath.Join(target, latestLinkName)
+	archives, err := listArchives(target, trash)
+	if err != nil {
+		return err
+	}
+	if len(archives) == 0 {
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove '%s': %w", link, err)
+		}
+		return nil
+	}
+	newest, err := filepath.Rel(target, archives[len(archives)-1].Path)
+	if err != nil {
+		return fmt.Errorf("could not calculate relative path for '%s': %w", archives[len(archives)-1].Path, err)
+	}
+	if current, err := os.Readlink(link); err == nil && current == newest {
+		return nil
+	}
+	temp := link + ".tmp"
+	os.Remove(temp)
+	if err := os.Symlink(newest, temp); err != nil {
+		return fmt.Errorf("failed to create symlink '%s': %w", temp, err)
+	}
+	if err := os.Rename(temp, link); err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("failed to replace symlink '%s': %w", link, err)
+	}
+	return nil
+}
+
+// latestArchive returns the path of the newest archive in target, the one
+// the latest symlink points at, leaving out those in trash.
+func latestArchive(target, trash string) (string, error) {
+	archives, err := listArchives(target, trash)
+	if err != nil {
+		return "", err
+	}
+	if len(archives) == 0 {
+		return "", fmt.Errorf("no archives found in '%s'", target)
+	}
+	return archives[len(archives)-1].Path, nil
+}
+
+// refreshLatestLink updates the latest symlink if -latest-link is set. A
+// failure only logs a warning, since the archives themselves are fine.
+func refreshLatestLink(cfg Config) {
+	if !cfg.LatestLink {
+		return
+	}
+	if err := updateLatestLink(cfg.Target, trashDir(cfg)); err != nil {
+		log.Printf("Warning: could not update '%s' link: %v", latestLinkName, err)
+	}
+}
+
+// removeEmptyParents removes dir and its parents while they are empty, up to
+// but not including stop. It tidies up the -organize subdirectories after
+// pruning.
+func removeEmptyParents(dir, stop string) {
+	stop = filepath.Clean(stop)
+	for dir = filepath.Clean(dir); dir != stop && len(dir) > len(stop); dir = filepath.Dir(dir) {
+		if os.Remove(dir) != nil {
+			return
+		}
+	}
+}
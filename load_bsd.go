@@ -0,0 +1,35 @@
+//go:build darwin || freebsd
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"golang.org/x/sys/unix"
+)
+
+// loadAverage returns the one minute load average from the vm.loadavg
+// sysctl, a struct loadavg of three fixed point values and their scale.
+func loadAverage() (float64, error) {
+	data, err := unix.SysctlRaw("vm.loadavg")
+	if err != nil {
+		return 0, fmt.Errorf("failed to read load average: %w", err)
+	}
+	// struct loadavg { fixpt_t ldavg[3]; long fscale; }, with fixpt_t a
+	// uint32 and the long 4 bytes right after it on 32 bit systems, and 8
+	// bytes aligned to 8 on 64 bit ones.
+	var scale uint64
+	switch len(data) {
+	case 16:
+		scale = uint64(binary.NativeEndian.Uint32(data[12:16]))
+	case 24:
+		scale = binary.NativeEndian.Uint64(data[16:24])
+	default:
+		return 0, fmt.Errorf("failed to parse load average: unexpected size %d", len(data))
+	}
+	if scale == 0 {
+		return 0, fmt.Errorf("failed to parse load average: zero scale")
+	}
+	return float64(binary.NativeEndian.Uint32(data[0:4])) / float64(scale), nil
+}
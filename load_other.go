@@ -0,0 +1,10 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import "fmt"
+
+// loadAverage is not implemented on this platform.
+func loadAverage() (float64, error) {
+	return 0, fmt.Errorf("reading the load average is not supported on this platform")
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// errLockBusy is returned by tryLock when another process holds the lock.
+var errLockBusy = errors.New("lock is held by another process")
+
+// lockPollInterval is how often a held lock is retried while waiting for it.
+const lockPollInterval = 250 * time.Millisecond
+
+// acquireLock takes an exclusive lock on the file at path so that two runs
+// never work on the same target at once. If the lock is held, it is retried
+// until timeout has passed; a zero timeout fails immediately. The returned
+// function releases the lock. The lock file itself is left in place, since
+// removing it would let a waiting and a new process lock different files.
+func acquireLock(path string, timeout time.Duration) (func(), error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file '%s': %w", path, err)
+	}
+	deadline := time.Now().Add(timeout)
+	logged := false
+	for {
+		err = tryLock(file)
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, errLockBusy) || !time.Now().Before(deadline) {
+			file.Close()
+			if errors.Is(err, errLockBusy) && timeout > 0 {
+				return nil, fmt.Errorf("could not lock '%s' within %s: %w", path, timeout, err)
+			}
+			return nil, fmt.Errorf("could not lock '%s': %w", path, err)
+		}
+		if !logged {
+			log.Printf("Waiting up to %s for another run to release '%s'", timeout, path)
+			logged = true
+		}
+		time.Sleep(min(lockPollInterval, time.Until(deadline)))
+	}
+
+	// Record the holder for whoever finds the lock busy.
+	if err := file.Truncate(0); err == nil {
+		file.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	return func() {
+		if err := unlockFile(file); err != nil {
+			log.Printf("Warning: could not release lock '%s': %v", path, err)
+		}
+		file.Close()
+	}, nil
+}
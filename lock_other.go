@@ -0,0 +1,15 @@
+//go:build !linux && !darwin && !freebsd && !openbsd && !netbsd && !dragonfly && !windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// tryLock is not implemented on this platform.
+func tryLock(file *os.File) error {
+	return errors.New("file locking is not supported on this platform")
+}
+
+func unlockFile(file *os.File) error { return nil }
@@ -2,9 +2,14 @@ package main
 
 import (
 	"archive/tar"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
-	"hash/crc32"
+	"hash"
 	"io"
 	"log"
 	"os"
@@ -14,147 +19,1141 @@ import (
 	"github.com/klauspost/compress/zstd"
 )
 
+// reproducibleModTime is the fixed mtime written to every tar header when
+// timestamps are not preserved.
+var reproducibleModTime = time.Unix(0, 0)
+
+// Config holds the resolved settings for a backup run, merged from defaults,
+// flags and environment variables.
+type Config struct {
+	Source  string
+	Target  string
+	Verbose bool
+
+	// PreserveTimestamps keeps each file's mtime in its tar header. When
+	// false every header gets reproducibleModTime instead, so unchanged
+	// content always produces the same archive hash.
+	PreserveTimestamps bool
+
+	// NotifyURL is an optional webhook that receives a JSON payload after
+	// each run. NotifyThrottle limits success notifications to one per
+	// window; failures are always sent.
+	NotifyURL      string
+	NotifyThrottle time.Duration
+	// NotifyTransitions only notifies the first of a series of failed
+	// runs, and the run that succeeds again after them.
+	NotifyTransitions bool
+	// NotifyIncludeTOC lists this many of the largest files in
+	// notifications.
+	NotifyIncludeTOC int
+
+	// Metadata writes a <archive>.json sidecar describing the archive and
+	// its contents. ReportPath, if set, receives the run's Result as JSON.
+	Metadata   bool
+	ReportPath string
+	// ResultJSON, if set, receives the Result like ReportPath, but also
+	// when the run fails before it starts, e.g. on conflicting flags or
+	// a busy lock. The process exit code matches its exit_code.
+	ResultJSON string
+	// PromTextfile, if set, receives metrics of the run for node_exporter's
+	// textfile collector.
+	PromTextfile string
+
+	// Remotes lists destinations each archive is copied to after it has been
+	// created: s3://bucket/prefix URLs or local directories. Object keys are
+	// RemotePrefixTemplate rendered with the archive's nameFields, followed
+	// by the archive's filename.
+	Remotes              stringList
+	RemotePrefixTemplate string
+	S3Endpoint           string
+	S3Region             string
+	S3PathStyle          bool
+	S3Checksum           string
+	FailFastOnUpload     bool
+	// VerifyRemote checks every upload against the local file after it
+	// has been stored.
+	VerifyRemote bool
+	// TestBeforeUpload decodes the new archive completely before it is
+	// uploaded, so a corrupt archive never leaves the machine.
+	TestBeforeUpload bool
+	// KeepPartialOnError keeps the temporary archive when creating it
+	// fails, for debugging.
+	KeepPartialOnError bool
+	// DeterministicTempName gives the temporary archive, and the parts of
+	// -stream-split, fixed names instead of random ones, for debugging.
+	DeterministicTempName bool
+	// FileReadTimeout bounds the time spent reading a single file. Zero
+	// disables it.
+	FileReadTimeout time.Duration
+	// SkipSlowFiles keeps the backup going when a file hits
+	// FileReadTimeout instead of failing it.
+	SkipSlowFiles bool
+	// Keep is the number of archives kept in the target directory after a
+	// successful run. Zero keeps all of them.
+	Keep int
+	// MinFree is the free space the target directory must have before a
+	// run starts. PruneToFree removes old archives to reach it.
+	MinFree     byteSize
+	PruneToFree bool
+	// TargetQuota caps the total size of the target directory by pruning
+	// the oldest archives after each run.
+	TargetQuota byteSize
+	// KeepMin is the number of newest archives that size based pruning
+	// (-prune-to-free, -target-quota) never removes.
+	KeepMin int
+	// PruneToTrash moves archives pruned by Keep into TrashDir, by default
+	// <target>/.trash, where they are deleted after TrashRetention.
+	PruneToTrash   bool
+	TrashDir       string
+	TrashRetention time.Duration
+	// PruneProtectLabeled keeps every kind of pruning away from archives
+	// with a -label. Archives with a .keep marker are always protected.
+	PruneProtectLabeled bool
+	// Analyze prints a per-extension breakdown of the source instead of
+	// creating an archive.
+	Analyze bool
+	// Benchmark compresses the source with every zstd level and, for
+	// comparison, gzip, prints the results and exits. BenchmarkPrefer
+	// decides which level is recommended.
+	Benchmark       bool
+	BenchmarkPrefer string
+	// Scan writes a JSON inventory of the source, to ScanOut or stdout,
+	// instead of creating an archive.
+	Scan    bool
+	ScanOut string
+	// HashManifest writes the per-file hashes of the source to this file,
+	// or stdout for "-", and exits.
+	HashManifest string
+	// DiffManifest compares the source with the hash manifest in this file
+	// and prints the files that were added, changed or removed, then exits.
+	// JSON prints that as JSON instead of a table.
+	DiffManifest string
+	JSON         bool
+	// LockFile, when set, is locked for the duration of a backup so runs
+	// never overlap. LockTimeout is how long to wait for a held lock.
+	LockFile    string
+	LockTimeout time.Duration
+	// Organize stores archives in yyyy/mm subdirectories of the target.
+	// OrganizeLabeled stores labeled archives in labeled/<label> instead,
+	// out of reach of pruning.
+	Organize        bool
+	OrganizeLabeled bool
+	// LatestLink keeps a "latest" symlink in the target pointed at the
+	// newest archive.
+	LatestLink bool
+	// Redact masks credentials in URLs in the log. RedactPaths also
+	// replaces the names of archived files with hashes.
+	Redact      bool
+	RedactPaths bool
+	// LogCaller adds the source file and line of the call to every log
+	// line.
+	LogCaller bool
+	// Progress periodically logs how far a backup or restore has got.
+	Progress bool
+	// Paranoid decompresses the archive while it is written and checks that
+	// every entry roundtrips to the data that was read.
+	Paranoid bool
+	// Extension replaces .tar.zstd at the end of archive filenames.
+	Extension string
+	// Label is put in front of the archive filename, sanitized by
+	// sanitizeLabel, to mark a manual backup.
+	Label string
+	// Interval keeps the process running and backs up this often. Watch
+	// also backs up once the source has been quiet for Debounce after a
+	// change.
+	Interval time.Duration
+	Watch    bool
+	Debounce time.Duration
+	// IgnoreErrorsFor are patterns of files whose read errors only log a
+	// warning instead of failing the backup.
+	IgnoreErrorsFor stringList
+	// MinFileAge leaves out files modified more recently than this, as they
+	// may still be being written.
+	MinFileAge time.Duration
+	// ConsistencyCheck stats every archived file again after the archive
+	// is written and reports those that changed during the backup.
+	ConsistencyCheck bool
+	// ExternalPzstd, when set, is the pzstd binary archives are compressed
+	// with instead of the in-process encoder.
+	ExternalPzstd string
+	// Dict is a zstd dictionary archives are compressed with. AutoDict
+	// instead trains one from the source on the first run, keeps it in the
+	// target directory and trains a new one once it is older than
+	// DictRetrainInterval, if that is set.
+	Dict                string
+	AutoDict            bool
+	DictRetrainInterval time.Duration
+	// Seekable writes archives in the zstd seekable format, so single
+	// files can be read without decompressing everything before them.
+	Seekable bool
+	// SignKey is an Ed25519 private key used to sign each archive, and
+	// with SignManifest its metadata sidecar too.
+	SignKey      string
+	SignManifest bool
+	// VerifyAll checks every archive in the target directory and exits,
+	// reading up to VerifyConcurrency archives at the same time.
+	VerifyAll         bool
+	VerifyConcurrency int
+	// VerifySignature, when set, checks the signature of this archive
+	// against the public key SignPub instead of creating an archive.
+	VerifySignature string
+	SignPub         string
+	// ParallelUploads streams each file to all destinations at once,
+	// reading it only once.
+	ParallelUploads bool
+	// StreamSplit, when set, uploads the archive in parts of this size while
+	// it is written instead of storing it in the target directory, which
+	// only receives the manifest of the parts.
+	StreamSplit byteSize
+
+	// ChecksumBoth additionally computes a SHA-256 of the archive, written to
+	// a <archive>.sha256 sidecar and the metadata, while the short CRC32
+	// stays in the filename.
+	ChecksumBoth bool
+	// HashAlgorithm is the hash in the filename: crc32, sha256 or xxhash.
+	// HashTruncate, if not 0, keeps only that many hex characters of it.
+	HashAlgorithm string
+	HashTruncate  int
+
+	// MaxPerDay skips the run, with a warning, once the target already holds
+	// this many archives dated today. 0 means no limit.
+	MaxPerDay int
+
+	// Passphrase, read from PassphraseFile or VWBPASSPHRASE, encrypts
+	// archives with age. HashStage decides whether the filename hash is over
+	// the compressed archive (pre-encrypt) or the encrypted file
+	// (post-encrypt).
+	Passphrase     string
+	PassphraseFile string
+	HashStage      string
+
+	// Excludes are glob patterns of source paths to leave out of the
+	// archive. ExcludeVaultwardenTmp adds vaultwardenTmpPatterns.
+	Excludes              stringList
+	ExcludeVaultwardenTmp bool
+	// IncludeHidden archives entries whose name starts with a dot.
+	IncludeHidden bool
+	// FollowSymlinks archives the files and directories symlinks point to
+	// instead of the links.
+	FollowSymlinks bool
+	// FastScan reads the directories of the source concurrently.
+	FastScan bool
+	// OneFilesystem does not descend into mount points under the source,
+	// except those listed in FollowMounts.
+	OneFilesystem bool
+	FollowMounts  stringList
+	// SkipSpecial leaves FIFOs and device nodes out of the archive.
+	SkipSpecial bool
+	// OnlyExtensions, when set, limits the archive to files with one of
+	// these extensions.
+	OnlyExtensions stringList
+
+	// MaxTotalSize aborts the run before archiving if the source holds more
+	// than this many bytes, protecting the target from a runaway source.
+	// Force turns such safety checks into warnings, Strict turns warnings
+	// about an incomplete source, such as missing RSA keys, into errors.
+	MaxTotalSize byteSize
+	// MaxMemory, when set, turns off or downgrades options that need a lot
+	// of memory when the budget is low, see applyMemoryBudget.
+	MaxMemory byteSize
+	Force     bool
+	Strict    bool
+	// DetectRemount fails the run if a source directory is on a different
+	// device than in the last successful run.
+	DetectRemount bool
+
+	// CompressionLevel is a name from compressionLevels or "auto", which
+	// picks one from the source size using the AutoLevel thresholds.
+	CompressionLevel string
+	AutoLevelSmall   byteSize
+	AutoLevelLarge   byteSize
+	// AdaptiveCompression lowers the level when the system load per CPU
+	// is above AdaptiveLoadLow, down to fastest from AdaptiveLoadHigh on.
+	AdaptiveCompression bool
+	AdaptiveLoadLow     float64
+	AdaptiveLoadHigh    float64
+	// MinRatio warns, or with Strict fails, when the uncompressed size of
+	// the files divided by the archive size is below it.
+	MinRatio float64
+
+	// Restore, when Restore.Archive is set, restores an archive instead of
+	// creating one.
+	Restore RestoreOptions
+	// RestoreLatest restores the newest archive in the target directory.
+	RestoreLatest bool
+	// RestoreDocker restores into a path of a Docker container, given as
+	// container:/path, staging the files in Restore.To if set.
+	RestoreDocker string
+	// List, when set, prints the contents of this archive (a local path or
+	// an s3://bucket/key URL) instead of creating one.
+	List string
+	// RestoreDB, when set, extracts only the database from this archive
+	// into RestoreDBOut.
+	RestoreDB    string
+	RestoreDBOut string
+}
+
+// archive describes a finished archive produced by createTarball.
+type archive struct {
+	Path    string
+	Hash    string // full hex digest of the -hash algorithm
+	Fields  nameFields
+	Size    int64  // size of the compressed archive on disk
+	Files   int    // number of regular files archived
+	Bytes   int64  // total uncompressed size of the regular files
+	SHA256  string // hex SHA-256 of the archive, set with -checksum-both
+	Entries []manifestEntry
+	// Dict is the hex id of the dictionary the archive was compressed
+	// with, if any.
+	Dict string
+	// Sidecars lists files written next to the archive, such as the
+	// metadata, which are uploaded along with it.
+	Sidecars []string
+	// Incomplete lists entries whose content was zero-filled after
+	// hitting -file-read-timeout with -skip-slow-files.
+	Incomplete []string
+	// IgnoredErrors lists entries matching -ignore-errors-for that could
+	// not be read, and were left out or zero-filled.
+	IgnoredErrors []string
+	// Changed lists files whose size or modification time changed while
+	// they were being archived, found by -consistency-check.
+	Changed []string
+}
+
 // CreateDatedZstdTarball takes a backups path and a target directory, creates a
 // zstd-compressed tarball of the backups, and saves it to the target directory.
 // A CRC32 hash of the archive's content is always included in the filename
 // (mm-dd-yyyy-crc32hash.tar.zstd) to ensure uniqueness for each revision.
-// It returns true on success and false on any error.
-func CreateDatedZstdTarball(sourcePath, targetDir string, verbose bool) bool {
-	finalPath, err := createTarball(sourcePath, targetDir, verbose)
+// It returns the Result of the run; Result.Success is false on any error.
+// Cancelling ctx aborts the uploads of the run.
+func CreateDatedZstdTarball(ctx context.Context, cfg Config) Result {
+	res := newResult(cfg)
+	arc, err := runBackup(ctx, cfg, &res)
+	res.finish(arc, err)
 	if err != nil {
-		log.Printf("Error creating tarball: %v", err)
-		return false
+		log.Printf("Error during backup: %v", err)
+	}
+
+	notifyResult(cfg, res, arc)
+	if cfg.ReportPath != "" {
+		if err := writeReport(cfg.ReportPath, res); err != nil {
+			log.Printf("Error writing report: %v", err)
+		}
 	}
-	log.Printf("Successfully created unique tarball: %s", finalPath)
-	return true
+	writeResultJSON(cfg, res)
+	if cfg.PromTextfile != "" {
+		if err := writePromTextfile(cfg.PromTextfile, res); err != nil {
+			log.Printf("Error writing metrics: %v", err)
+		}
+	}
+	return res
 }
 
-// createTarball is the internal implementation that handles the logic and returns
-// the final path of the created archive or a detailed error.
-func createTarball(sourcePath, targetDir string, verbose bool) (string, error) {
-	// 1. Validate backups path
-	sourceInfo, err := os.Stat(sourcePath)
+// runBackup performs the steps of a run in order, stopping at the first error.
+// The archive is returned even if a later step such as an upload fails.
+func runBackup(ctx context.Context, cfg Config, res *Result) (*archive, error) {
+	dests, err := openDestinations(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxPerDay > 0 {
+		today := time.Now().Format("01-02-2006")
+		count, err := countArchivesOn(cfg.Target, trashDir(cfg), today)
+		if err != nil {
+			return nil, err
+		}
+		if count >= cfg.MaxPerDay {
+			res.Skipped = fmt.Sprintf("%d archives already created today, -max-per-day is %d", count, cfg.MaxPerDay)
+			log.Printf("Warning: skipping backup, %s", res.Skipped)
+			return nil, nil
+		}
+	}
+	var signingKey ed25519.PrivateKey
+	if cfg.SignKey != "" {
+		if signingKey, err = loadSigningKey(cfg.SignKey); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.MinFree > 0 {
+		if err := ensureFreeSpace(cfg, res); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.CompressionLevel != levelAuto {
+		if _, err := encoderLevel(cfg.CompressionLevel); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.ExternalPzstd != "" {
+		path, err := findPzstd(cfg.ExternalPzstd)
+		if err != nil {
+			log.Printf("Warning: %v, compressing in-process instead", err)
+		}
+		cfg.ExternalPzstd = path
+	}
+	var devices map[string]uint64
+	if cfg.DetectRemount {
+		if devices, err = checkSourceDevices(cfg); err != nil {
+			return nil, err
+		}
+	}
+	var expected sourceSize
+	if cfg.MaxTotalSize > 0 || cfg.CompressionLevel == levelAuto || cfg.Progress {
+		size, err := measureSource(cfg)
+		if err != nil {
+			return nil, err
+		}
+		expected = size
+		if err := checkSourceSize(cfg, size); err != nil {
+			return nil, err
+		}
+		if cfg.CompressionLevel == levelAuto {
+			cfg.CompressionLevel = autoLevel(cfg, size)
+		}
+	}
+	if cfg.AdaptiveCompression {
+		cfg.CompressionLevel = adaptiveLevel(cfg, cfg.CompressionLevel)
+	}
+	cfg.CompressionLevel = memoryLevel(cfg, cfg.CompressionLevel)
+	if cfg.Dict, err = selectDict(cfg); err != nil {
+		return nil, err
+	}
+	var split *splitWriter
+	if cfg.StreamSplit > 0 {
+		if split, err = newSplitWriter(ctx, cfg, dests); err != nil {
+			return nil, err
+		}
+	}
+	arc, err := createTarball(cfg, expected, split)
+	if split != nil {
+		res.Uploads = split.results
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to read backups path '%s': %w", sourcePath, err)
+		return nil, err
 	}
-	if !sourceInfo.IsDir() {
-		return "", fmt.Errorf("backups path '%s' is not a directory", sourcePath)
+	if split != nil {
+		log.Printf("Successfully uploaded split archive %s in %d parts, manifest: %s", arc.Fields.filename(), len(split.parts), arc.Path)
+	} else {
+		log.Printf("Successfully created unique tarball: %s", arc.Path)
+	}
+	warnEmptySource(cfg, arc)
+	if err := checkRatio(cfg, arc); err != nil {
+		return arc, err
+	}
+	if devices != nil {
+		if err := recordSourceDevices(cfg, devices); err != nil {
+			log.Printf("Warning: could not record source devices: %v", err)
+		}
+	}
+	if split != nil {
+		// The parts and the manifest are uploaded already, and there is no
+		// local archive to link to, checksum, sign or test.
+		if err := split.err(); err != nil {
+			return arc, err
+		}
+	} else {
+		refreshLatestLink(cfg)
+	}
+	if arc.SHA256 != "" && split == nil {
+		if err := writeChecksumFile(cfg, arc); err != nil {
+			return arc, err
+		}
+	}
+	if cfg.Metadata {
+		if err := writeMetadata(cfg, arc); err != nil {
+			return arc, err
+		}
+	}
+	if signingKey != nil {
+		if err := signArchive(cfg, signingKey, arc); err != nil {
+			return arc, err
+		}
+	}
+	if len(dests) > 0 && cfg.TestBeforeUpload && split == nil {
+		if err := testArchive(arc.Path, cfg.Passphrase); err != nil {
+			return arc, fmt.Errorf("not uploading '%s': %w", arc.Path, err)
+		}
+		log.Printf("Archive test passed, uploading")
+	}
+	if len(dests) > 0 && split == nil {
+		res.Uploads, err = uploadArchive(ctx, cfg, dests, arc)
+		if err != nil {
+			return arc, err
+		}
+	}
+	var trash string
+	if cfg.PruneToTrash {
+		trash = trashDir(cfg)
+		if _, err := sweepTrash(trash, cfg.TrashRetention); err != nil {
+			log.Printf("Warning: %v", err)
+		}
+	}
+	if cfg.Keep > 0 {
+		pruned, freed, err := PruneBackups(cfg.Target, cfg.Keep, trash, cfg.PruneProtectLabeled, cfg.Verbose)
+		res.Pruned = append(res.Pruned, pruned...)
+		if len(pruned) > 0 && trash != "" {
+			log.Printf("Moved %d old archives (%s) to %s", len(pruned), formatBytes(freed), trash)
+			refreshLatestLink(cfg)
+		} else if len(pruned) > 0 {
+			log.Printf("Pruned %d old archives, freed %s", len(pruned), formatBytes(freed))
+			refreshLatestLink(cfg)
+		}
+		if err != nil {
+			return arc, err
+		}
+	}
+	if cfg.TargetQuota > 0 {
+		if err := enforceQuota(cfg, res); err != nil {
+			return arc, err
+		}
+	}
+	return arc, nil
+}
+
+// createTarball is the internal implementation that handles the logic and returns
+// the created archive or a detailed error. expected is the measured size of
+// the source, if it was measured, and is only used for -progress. With
+// -stream-split the archive is written to split, which uploads it in parts,
+// and the returned archive is its manifest.
+func createTarball(cfg Config, expected sourceSize, split *splitWriter) (arc *archive, err error) {
+	targetDir, verbose := cfg.Target, cfg.Verbose
+
+	// 1. Validate backups path, expanding it if it is a glob
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return nil, err
 	}
 
 	// 2. Ensure the target directory exists
 	if err := os.MkdirAll(targetDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create target directory '%s': %w", targetDir, err)
+		return nil, fmt.Errorf("failed to create target directory '%s': %w", targetDir, err)
 	}
 
-	// 3. Create a temporary file to build the archive. This prevents partial files.
-	tempFile, err := os.CreateTemp(targetDir, "backup-*.tmp")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temporary file: %w", err)
+	// 3. Create a temporary file to build the archive. This prevents partial
+	// files. A split archive is never stored whole.
+	var out io.Writer = split
+	var tempFile *os.File
+	if split == nil {
+		if tempFile, err = createTemp(targetDir, "backup-*.tmp", cfg.DeterministicTempName); err != nil {
+			return nil, fmt.Errorf("failed to create temporary file: %w", err)
+		}
+		defer func() {
+			// Clean up temp file on error, unless it was asked to be kept
+			if err != nil && cfg.KeepPartialOnError {
+				log.Printf("Keeping partial archive for inspection: %s", tempFile.Name())
+				return
+			}
+			os.Remove(tempFile.Name())
+		}()
+		defer tempFile.Close()
+		out = tempFile
+	} else {
+		defer split.abort()
 	}
-	defer os.Remove(tempFile.Name()) // Clean up temp file on error
-	defer tempFile.Close()
 
-	// 4. Set up the CRC32 hasher and the MultiWriter to write to both the
-	// temp file and the hasher simultaneously.
-	hasher := crc32.NewIEEE()
-	multiWriter := io.MultiWriter(tempFile, hasher)
+	// 4. Set up the filename hasher (CRC32 unless -hash says otherwise) and
+	// the MultiWriter to write to both the temp file and the hasher
+	// simultaneously. With -checksum-both a SHA-256 hasher is fed from the
+	// same stream, so both come from a single pass.
+	//
+	// When encrypting, the hashers sit after the encryption (post-encrypt,
+	// the default) so the file on disk can be verified without the
+	// passphrase, or before it (pre-encrypt) so they track plaintext changes.
+	hasher, err := newNameHasher(cfg.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+	hashers := []io.Writer{hasher}
+	var sha256Hasher hash.Hash
+	if cfg.ChecksumBoth && cfg.HashAlgorithm == hashSHA256 {
+		sha256Hasher = hasher
+	} else if cfg.ChecksumBoth {
+		sha256Hasher = sha256.New()
+		hashers = append(hashers, sha256Hasher)
+	}
+	var multiWriter io.Writer = io.MultiWriter(append([]io.Writer{out}, hashers...)...)
+	var encWriter io.WriteCloser
+	if cfg.Passphrase != "" {
+		fileWriter := out
+		if cfg.HashStage == hashStagePostEncrypt {
+			fileWriter = multiWriter
+		}
+		if encWriter, err = newEncryptWriter(fileWriter, cfg.Passphrase); err != nil {
+			return nil, err
+		}
+		multiWriter = encWriter
+		if cfg.HashStage == hashStagePreEncrypt {
+			multiWriter = io.MultiWriter(append([]io.Writer{encWriter}, hashers...)...)
+		}
+	}
 
 	// 5. Set up the chain of writers: file content -> tar -> zstd -> multiWriter
-	zstdWriter, err := zstd.NewWriter(multiWriter,
-		zstd.WithEncoderLevel(zstd.SpeedBestCompression))
+	level, err := encoderLevel(cfg.CompressionLevel)
+	if err != nil {
+		return nil, err
+	}
+	encoderOpts := append([]zstd.EOption{zstd.WithEncoderLevel(level)}, encoderMemoryOptions(cfg)...)
+	var dict uint32
+	if cfg.Dict != "" {
+		option, id, err := encoderDict(cfg.Dict)
+		if err != nil {
+			return nil, err
+		}
+		encoderOpts = append(encoderOpts, option)
+		dict = id
+	}
+	// With -paranoid the compressed stream is also fed to a verifier that
+	// decompresses it again and checks every entry as it goes.
+	var verifier *roundtripVerifier
+	zstdOutput := multiWriter
+	if cfg.Paranoid {
+		verifier = newRoundtripVerifier()
+		defer verifier.abort()
+		zstdOutput = io.MultiWriter(multiWriter, verifier)
+	}
+	var zstdWriter io.WriteCloser
+	if cfg.ExternalPzstd != "" {
+		var external *externalCompressor
+		if external, err = newExternalCompressor(cfg.ExternalPzstd, cfg.CompressionLevel, zstdOutput); err == nil {
+			defer external.kill()
+			zstdWriter = external
+		}
+	} else if cfg.Seekable {
+		zstdWriter, err = newSeekableWriter(zstdOutput, encoderOpts...)
+	} else {
+		zstdWriter, err = zstd.NewWriter(zstdOutput, encoderOpts...)
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to create zstd writer: %w", err)
+		return nil, fmt.Errorf("failed to create zstd writer: %w", err)
 	}
 	tarWriter := tar.NewWriter(zstdWriter)
+	arc = &archive{}
+	if dict != 0 {
+		arc.Dict = fmt.Sprintf("%08x", dict)
+	}
+	filter, err := newSourceFilter(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkVaultwardenFiles(cfg, roots, filter); err != nil {
+		return nil, err
+	}
 
 	// 6. Walk the backups directory and add files to the tarball.
-	walkErr := filepath.Walk(sourcePath, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
+	var prog *progress
+	var contentWriter io.Writer = tarWriter
+	var snapshots []fileSnapshot
+	if cfg.Progress {
+		prog = startProgress("Backup", expected.Bytes)
+		defer prog.stop()
+		contentWriter = prog.writer(tarWriter)
+	}
+	onExclude := func(name string, info os.FileInfo) {
+		if filter.tooRecent(info) {
+			log.Printf("Skipping '%s', modified %s ago, it will be archived by a later run", logName(name), time.Since(info.ModTime()).Round(time.Second))
+			return
 		}
-		if path == sourcePath {
-			return nil
+		warnExcludedWAL(name, info)
+		warnExcludedEnv(name, info)
+		if verbose == true {
+			log.Printf("Excluded from archive: %s", logName(name))
+		}
+	}
+	walkErr := walkSource(roots, filter, onExclude, func(path, name string, info os.FileInfo) error {
+		if kind := specialFileType(info.Mode()); kind != "" {
+			log.Printf("Warning: '%s' is a %s, archiving it as an entry without content (use -skip-special to leave it out)", logName(name), kind)
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			var linkErr error
+			if link, linkErr = readLink(path); linkErr != nil {
+				return fmt.Errorf("could not read symlink '%s': %w", path, linkErr)
+			}
 		}
-		header, err := tar.FileInfoHeader(info, info.Name())
+		header, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return fmt.Errorf("could not create tar header for '%s': %w", path, err)
 		}
-		relPath, err := filepath.Rel(sourcePath, path)
-		if err != nil {
-			return fmt.Errorf("could not calculate relative path for '%s': %w", path, err)
+		header.Name = name
+		if !cfg.PreserveTimestamps {
+			header.ModTime = reproducibleModTime
+			header.AccessTime = time.Time{}
+			header.ChangeTime = time.Time{}
+		}
+		// Open files before writing their header, so a file that cannot be
+		// opened and matches -ignore-errors-for can be left out entirely.
+		var file *os.File
+		if info.Mode().IsRegular() {
+			if file, err = os.Open(path); err != nil {
+				if filter.ignoreError(name) {
+					log.Printf("Warning: leaving out '%s': %v", logName(name), err)
+					arc.IgnoredErrors = append(arc.IgnoredErrors, name)
+					return nil
+				}
+				return fmt.Errorf("could not open file '%s' for archiving: %w", path, err)
+			}
+			defer file.Close()
 		}
-		header.Name = filepath.ToSlash(relPath)
 		if err := tarWriter.WriteHeader(header); err != nil {
 			return fmt.Errorf("could not write tar header for '%s': %w", header.Name, err)
 		}
+		arc.Entries = append(arc.Entries, newManifestEntry(header))
 		if !info.Mode().IsRegular() {
+			if verifier != nil {
+				verifier.expect(header.Name, nil)
+			}
 			return nil
 		}
-		file, err := os.Open(path)
-		if err != nil {
-			return fmt.Errorf("could not open file '%s' for archiving: %w", path, err)
+		fileWriter := contentWriter
+		var digest hash.Hash
+		if verifier != nil {
+			digest = sha256.New()
+			fileWriter = io.MultiWriter(contentWriter, digest)
 		}
-		defer file.Close()
-		if _, err := io.Copy(tarWriter, file); err != nil {
+		// A read error in a file matching -ignore-errors-for zero-fills the
+		// rest of its entry, errors writing the archive are always fatal.
+		// After a timeout the abandoned read may still fail at any time, so
+		// only the timeout counts then.
+		content := &readErrorReader{r: file}
+		timedOut, err := copyWithTimeout(fileWriter, content, header.Size, cfg.FileReadTimeout, cfg.SkipSlowFiles)
+		read, readErr := content.readState()
+		if err != nil && !timedOut && readErr != nil && filter.ignoreError(name) {
+			log.Printf("Warning: reading '%s' failed, its archived content is incomplete: %v", logName(name), readErr)
+			if _, err = io.CopyN(fileWriter, zeroReader{}, header.Size-read); err != nil {
+				return fmt.Errorf("could not copy file content from '%s' to tar archive: %w", path, err)
+			}
+			arc.IgnoredErrors = append(arc.IgnoredErrors, name)
+		} else if err != nil {
 			return fmt.Errorf("could not copy file content from '%s' to tar archive: %w", path, err)
 		}
+		if verifier != nil {
+			verifier.expect(header.Name, digest.Sum(nil))
+		}
+		if timedOut {
+			log.Printf("Warning: reading '%s' took longer than %s, its archived content is incomplete", logName(header.Name), cfg.FileReadTimeout)
+			arc.Incomplete = append(arc.Incomplete, header.Name)
+		}
+		if cfg.ConsistencyCheck {
+			snapshots = append(snapshots, newFileSnapshot(path, name, info))
+		}
+		arc.Files++
+		arc.Bytes += header.Size
+		if prog != nil {
+			prog.fileDone()
+		}
 		if verbose == true {
-			log.Printf("Added to archive: %s", header.Name)
+			log.Printf("Added to archive: %s", logName(header.Name))
 		}
 		return nil
 	})
 
 	// 7. IMPORTANT: Close writers to flush all data before getting the hash.
 	if err := tarWriter.Close(); err != nil {
-		return "", fmt.Errorf("failed to close tar writer: %w", err)
+		return nil, fmt.Errorf("failed to close tar writer: %w", err)
 	}
 	if err := zstdWriter.Close(); err != nil {
-		return "", fmt.Errorf("failed to close zstd writer: %w", err)
+		return nil, fmt.Errorf("failed to close zstd writer: %w", err)
+	}
+	if verifier != nil && walkErr == nil {
+		if err := verifier.finish(); err != nil {
+			return nil, err
+		}
+		log.Printf("Paranoid check passed: all %d entries decompress to the data that was read", len(arc.Entries))
+	}
+	if encWriter != nil {
+		if err := encWriter.Close(); err != nil {
+			return nil, fmt.Errorf("failed to close encryption writer: %w", err)
+		}
 	}
 
 	if walkErr != nil {
-		return "", fmt.Errorf("error during directory walk: %w", walkErr)
+		return nil, fmt.Errorf("error during directory walk: %w", walkErr)
+	}
+	if cfg.ConsistencyCheck {
+		arc.Changed = changedFiles(snapshots)
+		if len(arc.Changed) > 0 {
+			log.Printf("Warning: %d of %d files changed during the backup, their archived content may be inconsistent", len(arc.Changed), len(snapshots))
+		} else {
+			log.Printf("Consistency check passed: none of the %d files changed during the backup", len(snapshots))
+		}
 	}
 
 	// 8. Get the final hash and determine the unique, final filename.
-	hash := hasher.Sum32()
-	dateStr := time.Now().Format("01-02-2006")
-	// Filename format is always: mm-dd-yyyy-crc32hash.tar.zstd
-	finalFilename := fmt.Sprintf("%s-%x.tar.zstd", dateStr, hash)
-	finalPath := filepath.Join(targetDir, finalFilename)
+	// The filename may carry only the start of the digest; the metadata and
+	// report keep all of it.
+	digest := hashDigest(hasher)
+	fields := newNameFields(time.Now(), nameHash(digest, cfg.HashTruncate), cfg.Extension)
+	fields.Label = cfg.Label
+	if cfg.Passphrase != "" {
+		fields.Ext += encryptedExtension
+	}
+	// Filename format is always: mm-dd-yyyy-hash.tar.zstd, or the
+	// -extension in place of .tar.zstd, with the -label in front
+	finalFilename := fields.filename()
+	finalDir := archiveDir(cfg, fields)
+	finalPath := filepath.Join(finalDir, finalFilename)
+	arc.Hash = digest
+	arc.Fields = fields
+	if sha256Hasher != nil {
+		arc.SHA256 = hex.EncodeToString(sha256Hasher.Sum(nil))
+	}
+	if split != nil {
+		if arc.Path, err = split.finish(arc, finalDir); err != nil {
+			return nil, err
+		}
+		arc.Size = split.total
+		return arc, nil
+	}
 
 	// 9. Close the temp file and atomically rename it to its final destination.
+	// An archive already stored under that name is only replaced if it is
+	// the same archive, not one whose hash merely starts the same way.
 	tempFile.Close()
+	if err := os.MkdirAll(finalDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create archive directory '%s': %w", finalDir, err)
+	}
+	if err := checkNameCollision(cfg, finalPath, digest); err != nil {
+		return nil, err
+	}
 	if err := os.Rename(tempFile.Name(), finalPath); err != nil {
-		return "", fmt.Errorf("failed to rename temporary file to final path: %w", err)
+		return nil, fmt.Errorf("failed to rename temporary file to final path: %w", err)
 	}
 
-	return finalPath, nil
+	finalInfo, err := os.Stat(finalPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat final archive '%s': %w", finalPath, err)
+	}
+	arc.Path = finalPath
+	arc.Size = finalInfo.Size()
+	return arc, nil
 }
 
 // main function to demonstrate usage.
 func main() {
-	sourceDir := "/data"
-	targetDir := "/backups"
-	verbose := false
+	var cfg Config
 
-	flag.StringVar(&sourceDir, "source", "/data", "The backups location for the data being backed up")
-	flag.StringVar(&targetDir, "target", "/backups", "The directory where backups will be stored")
-	flag.BoolVar(&verbose, "verbose", false, "Whether or not to log files being added")
+	flag.StringVar(&cfg.Source, "source", "/data", "The backups location for the data being backed up")
+	flag.StringVar(&cfg.Target, "target", "/backups", "The directory where backups will be stored")
+	flag.BoolVar(&cfg.Verbose, "verbose", false, "Whether or not to log files being added")
+	flag.BoolVar(&cfg.PreserveTimestamps, "preserve-timestamps", true, "Store file modification times, false zeroes them for reproducible hashes")
+	flag.StringVar(&cfg.NotifyURL, "notify-url", "", "Webhook URL that receives a JSON payload after each run")
+	flag.DurationVar(&cfg.NotifyThrottle, "notify-throttle", 24*time.Hour, "Minimum time between success notifications, 0 to notify on every success")
+	flag.BoolVar(&cfg.NotifyTransitions, "notify-transitions", false, "Only notify the first failure of an outage, and the recovery once a run succeeds again")
+	flag.IntVar(&cfg.NotifyIncludeTOC, "notify-include-toc", 0, "List this many of the largest archived files in notifications")
+	flag.BoolVar(&cfg.Metadata, "metadata", false, "Write a <archive>.json metadata sidecar next to each archive")
+	flag.StringVar(&cfg.ReportPath, "report", "", "Write the result of the backup or restore as JSON to this file")
+	flag.StringVar(&cfg.ResultJSON, "result-json", "", "Write the result as JSON to this file on every exit, including setup errors, for CI pipelines")
+	flag.Var(&cfg.Remotes, "remote", "Copy each archive to this s3://bucket/prefix URL or directory, may be repeated")
+	flag.StringVar(&cfg.RemotePrefixTemplate, "remote-prefix-template", "", "Template for the key prefix of uploaded archives, e.g. {{.Year}}/{{.Month}}/")
+	flag.StringVar(&cfg.S3Endpoint, "s3-endpoint", "", "Custom S3 endpoint URL for S3 compatible storage such as MinIO")
+	flag.StringVar(&cfg.S3Region, "s3-region", "", "S3 region, defaults to the AWS SDK configuration")
+	flag.BoolVar(&cfg.S3PathStyle, "s3-path-style", false, "Use path-style S3 addressing, needed by most S3 compatible servers")
+	flag.StringVar(&cfg.S3Checksum, "s3-checksum", "", "Send a checksum of this algorithm with every part of an S3 upload for S3 to validate: sha256, sha1, crc32 or crc32c")
+	flag.BoolVar(&cfg.FailFastOnUpload, "fail-fast-on-upload", false, "Stop uploading to remaining destinations after the first failed upload")
+	flag.Var(&cfg.MaxMemory, "max-memory", "Memory budget, e.g. 256MB; options that need more are downgraded or turned off")
+	flag.Var(&cfg.MaxTotalSize, "max-total-size", "Abort before archiving if the source is larger than this, e.g. 50GB")
+	flag.BoolVar(&cfg.Strict, "strict", false, "Fail instead of warning when the source looks incomplete, e.g. without Vaultwarden's RSA keys")
+	flag.BoolVar(&cfg.DetectRemount, "detect-remount", false, "Fail if a source directory is on a different device than in the last successful run, e.g. because a mount dropped")
+	flag.BoolVar(&cfg.Force, "force", false, "Continue even if a safety check such as -max-total-size or the restore free space check fails")
+	flag.StringVar(&cfg.CompressionLevel, "level", "best", "Compression level: fastest, default, better, best or auto")
+	cfg.AutoLevelSmall = 1e9
+	cfg.AutoLevelLarge = 20e9
+	flag.Var(&cfg.AutoLevelSmall, "auto-level-small", "With -level auto, sources smaller than this use the best level")
+	flag.Var(&cfg.AutoLevelLarge, "auto-level-large", "With -level auto, sources at least this large use the fastest level")
+	flag.BoolVar(&cfg.AdaptiveCompression, "adaptive-compression", false, "Lower the compression level while the system is busy, judged by the load average per CPU")
+	flag.Float64Var(&cfg.AdaptiveLoadLow, "adaptive-load-low", 0.5, "With -adaptive-compression, a load per CPU above this lowers the level by one step")
+	flag.Float64Var(&cfg.AdaptiveLoadHigh, "adaptive-load-high", 1.0, "With -adaptive-compression, a load per CPU at or above this uses the fastest level")
+	flag.Float64Var(&cfg.MinRatio, "min-ratio", 0, "Warn, or fail with -strict, when the compression ratio is below this, e.g. 1.5 (0 disables)")
+	flag.StringVar(&cfg.Restore.Archive, "restore", "", "Restore this archive instead of creating a backup")
+	flag.BoolVar(&cfg.RestoreLatest, "restore-latest", false, "Restore the newest archive in the target directory")
+	flag.StringVar(&cfg.Restore.To, "restore-to", "", "Directory to restore the archive into")
+	flag.StringVar(&cfg.RestoreDocker, "restore-docker", "", "Restore into a stopped Docker container instead, as <container>:<path>, e.g. vaultwarden:/data")
+	flag.BoolVar(&cfg.Restore.InPlace, "restore-in-place", false, "Restore directly into -restore-to instead of a new timestamped subdirectory of it")
+	flag.BoolVar(&cfg.Restore.Flatten, "restore-flatten", false, "Strip the leading directory from every archive entry, for archives whose content is wrapped in one, e.g. data/")
+	flag.Var(&cfg.Restore.Excludes, "restore-exclude", "Glob pattern of archive entries not to restore, e.g. icon_cache, may be repeated")
+	flag.StringVar(&cfg.Restore.Policy, "restore-policy", policySkip, "What to do with files that already exist: skip, overwrite or backup")
+	flag.BoolVar(&cfg.Restore.ProtectNewer, "restore-protect-newer", false, "Refuse to replace a db.sqlite3 that is newer than the one in the archive, unless -force is set; requires -restore-in-place and -restore-policy overwrite or backup")
+	flag.BoolVar(&cfg.Restore.VerifyManifest, "verify-manifest", false, "Before restoring, check the entries of the archive against its metadata sidecar and refuse to restore if they differ, unless -force is set")
+	flag.BoolVar(&cfg.Restore.Immutable, "restore-immutable", false, "After restoring, make the restored files and directories immutable (chattr +i on Linux, chflags uchg on macOS and FreeBSD, read-only elsewhere)")
+	flag.BoolVar(&cfg.Restore.PreserveSparse, "restore-preserve-sparse", false, "Recreate files stored as sparse entries as sparse files, leaving holes instead of writing zeros")
+	flag.StringVar(&cfg.HashAlgorithm, "hash", hashCRC32, "Hash in archive filenames: crc32, sha256 or xxhash")
+	flag.IntVar(&cfg.HashTruncate, "hash-truncate", 0, "Use only the first N hex characters of the hash in filenames, the full hash is kept in the metadata (0 keeps all)")
+	flag.BoolVar(&cfg.ChecksumBoth, "checksum-both", false, "Also compute a SHA-256 of the archive for a .sha256 sidecar and the metadata")
+	flag.Var(&cfg.Excludes, "exclude", "Glob pattern of files or directories to leave out, may be repeated")
+	flag.BoolVar(&cfg.ExcludeVaultwardenTmp, "exclude-vw-tmp", false, "Leave out Vaultwarden and SQLite transient files (*.tmp, journals, WAL and shm)")
+	flag.StringVar(&cfg.PromTextfile, "prom-textfile", "", "Write metrics of the run to this .prom file for node_exporter's textfile collector")
+	flag.StringVar(&cfg.PassphraseFile, "passphrase-file", "", "Encrypt archives with the passphrase in this file, VWBPASSPHRASE is used if not set")
+	flag.StringVar(&cfg.HashStage, "hash-stage", hashStagePostEncrypt, "Compute the filename hash pre-encrypt or post-encrypt")
+	flag.StringVar(&cfg.RestoreDB, "restore-db", "", "Extract only db.sqlite3 from this archive, a local path or s3://bucket/key, then exit")
+	flag.StringVar(&cfg.RestoreDBOut, "out", "", "File to write the database extracted by -restore-db to")
+	flag.StringVar(&cfg.List, "list", "", "Print the contents of this archive, a local path or s3://bucket/key, then exit")
+	flag.IntVar(&cfg.MaxPerDay, "max-per-day", 0, "Skip the backup if this many archives were already created today, 0 for no limit")
+	flag.Var(&cfg.OnlyExtensions, "only-extensions", "Only archive files with these extensions, e.g. sqlite3,json,pem")
+	flag.BoolVar(&cfg.TestBeforeUpload, "test-before-upload", true, "Decode the whole archive before uploading it, and fail instead of uploading if it is corrupt")
+	flag.BoolVar(&cfg.VerifyRemote, "verify-remote", false, "Verify each upload against the local archive, re-downloading it if needed")
+	flag.BoolVar(&cfg.ParallelUploads, "parallel-uploads", false, "Read each file once and upload it to all remotes concurrently")
+	flag.Var(&cfg.StreamSplit, "stream-split", "Upload the archive to the remotes in parts of this size while it is written, e.g. 1GB, without storing it locally")
+	flag.BoolVar(&cfg.KeepPartialOnError, "keep-partial-on-error", false, "Keep the temporary backup-*.tmp file if creating the archive fails")
+	flag.BoolVar(&cfg.DeterministicTempName, "deterministic-temp-name", false, "Name the temporary archive backup-vwb.tmp instead of using a random name, for debugging")
+	flag.DurationVar(&cfg.FileReadTimeout, "file-read-timeout", 0, "Abort reading a file that takes longer than this, e.g. 30s (0 disables)")
+	flag.BoolVar(&cfg.SkipSlowFiles, "skip-slow-files", false, "Keep going when a file hits -file-read-timeout, zero-filling the rest of its content")
+	flag.IntVar(&cfg.Keep, "keep", 0, "Keep only this many archives in the target directory (0 keeps all)")
+	flag.Var(&cfg.MinFree, "min-free", "Fail before archiving if the target has less free space than this, e.g. 5GB")
+	flag.Var(&cfg.TargetQuota, "target-quota", "Prune the oldest archives after each run so the target directory uses at most this much, a trash inside it included, e.g. 50GB")
+	flag.BoolVar(&cfg.PruneProtectLabeled, "prune-protect-labeled", false, "Never prune archives with a -label, like those with a .keep marker file")
+	flag.BoolVar(&cfg.PruneToTrash, "prune-to-trash", false, "Move archives pruned by -keep to a trash directory instead of deleting them")
+	flag.StringVar(&cfg.TrashDir, "trash-dir", "", "Trash directory for -prune-to-trash, on the same file system as the target (default <target>/.trash)")
+	flag.DurationVar(&cfg.TrashRetention, "trash-retention", 7*24*time.Hour, "How long archives stay in the trash before they are deleted")
+	flag.IntVar(&cfg.KeepMin, "keep-min", 1, "Never remove the newest this many archives to free space or meet -target-quota")
+	flag.BoolVar(&cfg.PruneToFree, "prune-to-free", false, "With -min-free, remove the oldest archives until enough space is free")
+	flag.BoolVar(&cfg.Benchmark, "benchmark", false, "Compress the source with every zstd level and with gzip, print size and speed of each, then exit")
+	flag.StringVar(&cfg.BenchmarkPrefer, "benchmark-prefer", preferBalanced, "What the -benchmark recommendation optimizes for: ratio, speed or balanced")
+	flag.BoolVar(&cfg.Analyze, "analyze", false, "Print the size and estimated compression ratio of the source per file extension, then exit")
+	flag.BoolVar(&cfg.Scan, "scan", false, "Print a JSON inventory of everything that would be archived, then exit")
+	flag.StringVar(&cfg.ScanOut, "scan-out", "", "Write the -scan inventory to this file instead of stdout")
+	flag.StringVar(&cfg.DiffManifest, "diff-manifest", "", "Compare the source with this -hash-manifest file and print what was added, changed or removed since, then exit")
+	flag.BoolVar(&cfg.JSON, "json", false, "Print the output of -diff-manifest as JSON")
+	flag.StringVar(&cfg.HashManifest, "hash-manifest", "", "Write the -hash of every file that would be archived as JSON to this file, - for stdout, then exit")
+	flag.StringVar(&cfg.LockFile, "lockfile", "", "Lock this file while backing up so that runs never overlap")
+	flag.DurationVar(&cfg.LockTimeout, "lock-timeout", 0, "How long to wait for a -lockfile held by another run (0 fails immediately)")
+	flag.BoolVar(&cfg.IncludeHidden, "include-hidden", true, "Archive files and directories whose name starts with a dot, such as .env")
+	flag.BoolVar(&cfg.Organize, "organize", false, "Store archives in yyyy/mm subdirectories of the target directory")
+	flag.BoolVar(&cfg.OrganizeLabeled, "organize-labeled", false, "Store archives with a -label in labeled/<label> subdirectories of the target directory, where they are never pruned")
+	flag.BoolVar(&cfg.LatestLink, "latest-link", false, "Keep a 'latest' symlink in the target directory pointed at the newest archive")
+	flag.BoolVar(&cfg.Redact, "redact", false, "Mask passwords, query parameters and http(s) paths of URLs in the log")
+	flag.BoolVar(&cfg.LogCaller, "log-caller", false, "Add the source file and line that logged each message, for debugging")
+	flag.BoolVar(&cfg.RedactPaths, "redact-paths", false, "Replace the names of archived and restored files in the log with hashes")
+	flag.StringVar(&cfg.SignKey, "sign-key", "", "Sign each archive with this Ed25519 private key (PKCS #8 PEM), writing <archive>.sig")
+	flag.BoolVar(&cfg.SignManifest, "sign-manifest", false, "With -sign-key and -metadata, also sign the metadata sidecar")
+	flag.BoolVar(&cfg.VerifyAll, "verify-all", false, "Check the hash and decoding of every archive in the target directory, then exit")
+	flag.IntVar(&cfg.VerifyConcurrency, "verify-concurrency", 2, "Number of archives -verify-all reads at the same time; keep it low for spinning disks")
+	flag.StringVar(&cfg.VerifySignature, "verify-signature", "", "Check the signature of this archive, and of its metadata if signed, then exit")
+	flag.StringVar(&cfg.SignPub, "sign-pub", "", "Ed25519 public key (PEM) for -verify-signature")
+	flag.BoolVar(&cfg.Progress, "progress", false, "Log files and bytes processed and throughput every 10 seconds during a backup or restore")
+	flag.BoolVar(&cfg.FollowSymlinks, "follow-symlinks", false, "Archive what symlinks in the source point to instead of the links themselves")
+	flag.BoolVar(&cfg.FastScan, "fast-scan", false, "Read the directories of the source concurrently, faster for trees with very many small files")
+	flag.BoolVar(&cfg.OneFilesystem, "one-filesystem", false, "Do not archive the content of directories under the source that are on another file system")
+	flag.BoolVar(&cfg.SkipSpecial, "skip-special", false, "Leave FIFOs and device nodes out of the archive instead of archiving them as entries without content")
+	flag.Var(&cfg.FollowMounts, "follow-mounts", "With -one-filesystem, mount points under the source to archive anyway, e.g. attachments, may be repeated")
+	flag.BoolVar(&cfg.Paranoid, "paranoid", false, "Decompress the archive again while writing it and fail if any file does not roundtrip (about twice the CPU)")
+	flag.StringVar(&cfg.Label, "label", "", "Put this label in front of the archive filename, e.g. pre-upgrade, to mark a manual backup")
+	flag.StringVar(&cfg.Extension, "extension", archiveExtension, "Extension of archive filenames, e.g. .tzst (.age is still appended when encrypting)")
+	flag.DurationVar(&cfg.Interval, "interval", 0, "Keep running and back up this often, e.g. 6h (0 backs up once and exits)")
+	flag.BoolVar(&cfg.Watch, "watch", false, "Keep running and back up shortly after the source changes")
+	flag.DurationVar(&cfg.Debounce, "debounce", 30*time.Second, "With -watch, how long the source must be quiet after a change before backing up")
+	flag.Var(&cfg.IgnoreErrorsFor, "ignore-errors-for", "Glob pattern of files whose read errors are not fatal, e.g. 'sends/*', may be repeated")
+	flag.DurationVar(&cfg.MinFileAge, "min-file-age", 0, "Skip files modified within this duration, e.g. 5s, as they may still be being written")
+	flag.BoolVar(&cfg.ConsistencyCheck, "consistency-check", false, "After archiving, check the files again and report those that changed during the backup")
+	flag.StringVar(&cfg.ExternalPzstd, "external-pzstd", "", "Compress with this pzstd binary, e.g. pzstd or /usr/local/bin/pzstd, instead of in-process")
+	flag.StringVar(&cfg.Dict, "dict", "", "Compress with this zstd dictionary, needed again to restore the archives")
+	flag.BoolVar(&cfg.AutoDict, "auto-dict", false, "Train a zstd dictionary from the source on the first run and compress with it, kept in the target directory")
+	flag.DurationVar(&cfg.DictRetrainInterval, "dict-retrain-interval", 0, "With -auto-dict, train a new dictionary once the current one is this old, e.g. 720h. 0 never retrains")
+	flag.BoolVar(&cfg.Seekable, "seekable", false, "Write archives in the zstd seekable format for fast single file extraction")
+	showConfig := flag.Bool("dump-config", false, "Print the effective configuration as JSON, with secrets redacted, then exit")
+	showVersion := flag.Bool("version", false, "Print the version and build commit, then exit")
+	showSchema := flag.Bool("print-schema", false, "Print the JSON Schema of the -report output and the metadata sidecar, then exit")
 
 	flag.Parse()
 
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+	if *showSchema {
+		if err := printSchema(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if cfg.LogCaller {
+		log.SetFlags(log.LstdFlags | log.Lshortfile)
+	}
+	if cfg.Redact {
+		log.SetOutput(redactWriter{w: os.Stderr})
+	}
+	hashLoggedNames = cfg.RedactPaths
+	// Setup errors still write -result-json, so a pipeline always finds a
+	// result to inspect.
+	fatal := func(v ...any) {
+		failResult(cfg, errors.New(fmt.Sprint(v...)))
+		log.Fatal(v...)
+	}
+
 	if len(os.Getenv("VWBSOURCE")) != 0 && len(os.Getenv("VWBTARGET")) != 0 {
-		sourceDir = os.Getenv("VWBSOURCE")
-		targetDir = os.Getenv("VWBTARGET")
+		cfg.Source = os.Getenv("VWBSOURCE")
+		cfg.Target = os.Getenv("VWBTARGET")
+	}
+
+	passphrase, err := loadPassphrase(cfg.PassphraseFile)
+	if err != nil {
+		fatal(err)
+	}
+	cfg.Passphrase = passphrase
+	if err := checkHashStage(cfg.HashStage); err != nil {
+		fatal(err)
+	}
+	if err := checkExtension(cfg.Extension); err != nil {
+		fatal(err)
+	}
+	if cfg.Label != "" {
+		label, err := sanitizeLabel(cfg.Label)
+		if err != nil {
+			fatal(err)
+		}
+		if label != cfg.Label {
+			log.Printf("Using '%s' as the label of -label '%s'", label, cfg.Label)
+		}
+		cfg.Label = label
+	}
+	if err := checkHashOptions(cfg.HashAlgorithm, cfg.HashTruncate); err != nil {
+		fatal(err)
+	}
+	if err := checkS3Checksum(cfg.S3Checksum); err != nil {
+		fatal(err)
+	}
+	for _, p := range [][2]string{{"source", cfg.Source}, {"target", cfg.Target}, {"restore-to", cfg.Restore.To}} {
+		if err := checkDriveRelative(p[0], p[1]); err != nil {
+			fatal(err)
+		}
+	}
+	if cfg.AdaptiveLoadLow < 0 || cfg.AdaptiveLoadHigh <= cfg.AdaptiveLoadLow {
+		fatal("-adaptive-load-high must be above -adaptive-load-low, and neither can be negative")
+	}
+	if cfg.MinRatio < 0 {
+		fatal("-min-ratio cannot be negative")
+	}
+	if cfg.KeepMin < 0 {
+		fatal("-keep-min cannot be negative")
+	}
+	if cfg.ExternalPzstd != "" && cfg.Seekable {
+		fatal("-external-pzstd cannot be combined with -seekable")
+	}
+	if cfg.ExternalPzstd != "" && (cfg.Dict != "" || cfg.AutoDict) {
+		fatal("-external-pzstd cannot be combined with -dict or -auto-dict")
+	}
+	if len(cfg.FollowMounts) > 0 && !cfg.OneFilesystem {
+		log.Printf("Warning: -follow-mounts has no effect without -one-filesystem, every mount point under the source is archived")
+	}
+	if cfg.FastScan && cfg.FollowSymlinks {
+		log.Printf("Warning: -fast-scan has no effect with -follow-symlinks, the source is read one directory at a time")
+	}
+	if cfg.Dict != "" && cfg.AutoDict {
+		fatal("-dict cannot be combined with -auto-dict")
+	}
+	if err := loadDecoderDicts(cfg); err != nil {
+		fatal(err)
+	}
+	cfg = applyMemoryBudget(cfg)
+	if cfg.Extension != archiveExtension {
+		archiveExtensions = append(archiveExtensions, cfg.Extension)
+	}
+	if *showConfig {
+		if err := dumpConfig(os.Stdout, cfg); err != nil {
+			fatal(err)
+		}
+		os.Exit(exitSuccess)
 	}
 
-	log.Println("--- Starting Archive Process ---")
-	success := CreateDatedZstdTarball(sourceDir, targetDir, verbose)
-	if success {
+	if cfg.SignManifest && (cfg.SignKey == "" || !cfg.Metadata) {
+		fatal("-sign-manifest requires -sign-key and -metadata")
+	}
+	if cfg.StreamSplit > 0 && len(cfg.Remotes) == 0 {
+		fatal("-stream-split requires at least one -remote")
+	}
+	if cfg.StreamSplit > 0 && (cfg.Metadata || cfg.SignKey != "") {
+		fatal("-stream-split cannot be combined with -metadata or -sign-key")
+	}
+	if cfg.RestoreDocker != "" && cfg.Restore.Archive == "" && !cfg.RestoreLatest {
+		fatal("-restore-docker requires -restore or -restore-latest")
+	}
+	// Anywhere else a restore never replaces an existing database, so there
+	// is nothing for -restore-protect-newer to protect.
+	if cfg.Restore.ProtectNewer && (!cfg.Restore.InPlace || cfg.Restore.Policy == policySkip || cfg.RestoreDocker != "") {
+		fatal("-restore-protect-newer requires -restore-in-place and -restore-policy overwrite or backup, and cannot be combined with -restore-docker")
+	}
+	if cfg.VerifySignature != "" {
+		if cfg.SignPub == "" {
+			fatal("-verify-signature requires -sign-pub")
+		}
+		os.Exit(runVerifySignature(cfg))
+	}
+	if cfg.VerifyAll {
+		os.Exit(runVerifyAll(cfg))
+	}
+	if cfg.Analyze {
+		os.Exit(runAnalyze(cfg))
+	}
+	if cfg.Benchmark {
+		os.Exit(runBenchmark(cfg))
+	}
+	if cfg.Scan {
+		os.Exit(runScan(cfg))
+	}
+	if cfg.HashManifest != "" {
+		os.Exit(runHashManifest(cfg))
+	}
+	if cfg.DiffManifest != "" {
+		os.Exit(runDiffManifest(cfg))
+	}
+	if cfg.List != "" {
+		os.Exit(runList(cfg))
+	}
+	if cfg.RestoreDB != "" {
+		if cfg.RestoreDBOut == "" {
+			fatal("-restore-db requires -out")
+		}
+		os.Exit(runRestoreDB(cfg))
+	}
+	if cfg.RestoreLatest {
+		if cfg.Restore.Archive != "" {
+			fatal("-restore-latest and -restore cannot be used together")
+		}
+		newest, err := latestArchive(cfg.Target, trashDir(cfg))
+		if err != nil {
+			fatal(err)
+		}
+		log.Printf("Newest archive in %s is %s", cfg.Target, newest)
+		cfg.Restore.Archive = newest
+	}
+	if cfg.Restore.Archive != "" && cfg.RestoreDocker != "" {
+		if cfg.Restore.Immutable {
+			fatal("-restore-immutable cannot be combined with -restore-docker")
+		}
+		os.Exit(runRestoreDocker(cfg))
+	}
+	if cfg.Restore.Archive != "" {
+		if cfg.Restore.To == "" {
+			fatal("-restore requires -restore-to")
+		}
+		os.Exit(runRestore(cfg))
+	}
+
+	if cfg.Interval > 0 || cfg.Watch {
+		os.Exit(runDaemon(cfg))
+	}
+	os.Exit(runOnce(context.Background(), cfg))
+}
+
+// runOnce makes a single backup, holding -lockfile while it runs, and returns
+// the process exit code.
+func runOnce(ctx context.Context, cfg Config) int {
+	unlock := func() {}
+	if cfg.LockFile != "" {
+		var err error
+		if unlock, err = acquireLock(cfg.LockFile, cfg.LockTimeout); err != nil {
+			log.Printf("Error: %v", err)
+			failResult(cfg, err)
+			return exitFailure
+		}
+	}
+	defer unlock()
+	log.Printf("--- Starting Archive Process (%s) ---", versionString())
+	res := CreateDatedZstdTarball(ctx, cfg)
+	if res.Success {
 		log.Println("--- Archive process completed successfully! ---")
 	} else {
 		log.Println("--- Archive process failed. ---")
 	}
-
+	return res.ExitCode
 }
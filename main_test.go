@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testConfig returns the Config of a run with the flag defaults that
+// createTarball depends on, backing up source into target.
+func testConfig(source, target string) Config {
+	return Config{
+		Source:             source,
+		Target:             target,
+		PreserveTimestamps: true,
+		CompressionLevel:   "default",
+		HashAlgorithm:      hashCRC32,
+		HashStage:          hashStagePostEncrypt,
+		Extension:          archiveExtension,
+		IncludeHidden:      true,
+		KeepMin:            1,
+	}
+}
+
+// writeFiles creates the files of content, keyed by slash separated path,
+// under dir.
+func writeFiles(t *testing.T, dir string, content map[string]string) {
+	t.Helper()
+	for name, data := range content {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// archiveHeaders returns the headers of the entries of the archive at path,
+// in the order they were written.
+func archiveHeaders(t *testing.T, path string) []*tar.Header {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	tarReader, closeReader, err := newArchiveReader(file, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeReader()
+	var headers []*tar.Header
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return headers
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers = append(headers, header)
+	}
+}
+
+// archiveNames returns the names of the entries of the archive at path, in
+// the order they were written.
+func archiveNames(t *testing.T, path string) []string {
+	t.Helper()
+	var names []string
+	for _, header := range archiveHeaders(t, path) {
+		names = append(names, header.Name)
+	}
+	return names
+}
+
+func TestCreateTarballReproducible(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{
+		"config.db":              "database",
+		"config.json":            "{}",
+		"attachments/a/file.bin": "attachment",
+	})
+
+	var hashes []string
+	for i, mtime := range []time.Time{time.Now(), time.Now().Add(-48 * time.Hour)} {
+		for _, name := range []string{"config.db", "config.json", "attachments", "attachments/a", "attachments/a/file.bin"} {
+			if err := os.Chtimes(filepath.Join(source, filepath.FromSlash(name)), mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+		cfg := testConfig(source, t.TempDir())
+		cfg.PreserveTimestamps = false
+		arc, err := createTarball(cfg, sourceSize{}, nil)
+		if err != nil {
+			t.Fatalf("run %d: %v", i+1, err)
+		}
+		hashes = append(hashes, arc.Hash)
+	}
+	if hashes[0] != hashes[1] {
+		t.Errorf("archives of the same content have different hashes %s and %s with -preserve-timestamps=false", hashes[0], hashes[1])
+	}
+}
+
+func TestKeepPartialOnError(t *testing.T) {
+	source := t.TempDir()
+	// Without Vaultwarden's RSA keys next to the database, -strict fails
+	// the run once the temporary archive exists.
+	writeFiles(t, source, map[string]string{vaultwardenDBName: "database"})
+
+	for _, keep := range []bool{false, true} {
+		target := t.TempDir()
+		cfg := testConfig(source, target)
+		cfg.Strict = true
+		cfg.DeterministicTempName = true
+		cfg.KeepPartialOnError = keep
+		if _, err := createTarball(cfg, sourceSize{}, nil); err == nil {
+			t.Fatal("backup of a database without its keys succeeded with -strict")
+		}
+		_, err := os.Stat(filepath.Join(target, "backup-"+deterministicTempPart+".tmp"))
+		if keep && err != nil {
+			t.Errorf("partial archive not kept with -keep-partial-on-error: %v", err)
+		} else if !keep && err == nil {
+			t.Errorf("partial archive kept without -keep-partial-on-error")
+		}
+	}
+}
+
+func TestCreateTarballNameCollision(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"config.json": "{}"})
+	cfg := testConfig(source, t.TempDir())
+	cfg.PreserveTimestamps = false
+	arc, err := createTarball(cfg, sourceSize{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same archive again replaces the first one.
+	if _, err := createTarball(cfg, sourceSize{}, nil); err != nil {
+		t.Fatalf("storing an identical archive under the same name failed: %v", err)
+	}
+
+	// A different archive under that name, as a short -hash-truncate can
+	// give, is never replaced.
+	other := []byte("a different archive")
+	if err := os.WriteFile(arc.Path, other, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := createTarball(cfg, sourceSize{}, nil); err == nil {
+		t.Fatal("a different archive with the same name was replaced")
+	}
+	if data, err := os.ReadFile(arc.Path); err != nil || string(data) != string(other) {
+		t.Errorf("the existing archive was changed: %q, %v", data, err)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Memory budgets of -max-memory at which options are downgraded. Below
+// memoryLowCodecs the zstd encoder and decoders run with a single goroutine
+// in their low memory mode and S3 uploads send one part at a time. Below
+// memoryStreamingOnly everything that holds a second copy of the data in
+// flight is turned off too, and the largest zstd window is not used.
+const (
+	memoryLowCodecs     = 1 << 30
+	memoryStreamingOnly = 512 << 20
+)
+
+// memoryWindowSize is the zstd window used below memoryStreamingOnly.
+const memoryWindowSize = 1 << 20
+
+// lowMemoryCodecs makes encoderMemoryOptions and decoderOptions use the
+// zstd low memory settings, set by applyMemoryBudget.
+var lowMemoryCodecs bool
+
+// applyMemoryBudget implements -max-memory: it turns off the options that
+// need a lot of memory for the budget and logs each one it changes. The
+// compression level is capped later by memoryLevel, once -level auto has
+// been resolved.
+func applyMemoryBudget(cfg Config) Config {
+	budget := int64(cfg.MaxMemory)
+	if budget == 0 || budget >= memoryLowCodecs {
+		return cfg
+	}
+	lowMemoryCodecs = true
+	log.Printf("-max-memory %s: compressing and decompressing with one goroutine in low memory mode", formatBytes(budget))
+	for _, remote := range cfg.Remotes {
+		if strings.HasPrefix(remote, "s3://") {
+			log.Printf("-max-memory %s: uploading to S3 one part at a time", formatBytes(budget))
+			break
+		}
+	}
+	if budget >= memoryStreamingOnly {
+		return cfg
+	}
+	if cfg.Paranoid {
+		cfg.Paranoid = false
+		log.Printf("-max-memory %s: turning off -paranoid, which decompresses the archive a second time while it is written", formatBytes(budget))
+	}
+	if cfg.ParallelUploads {
+		cfg.ParallelUploads = false
+		log.Printf("-max-memory %s: turning off -parallel-uploads, uploading to one remote at a time", formatBytes(budget))
+	}
+	if cfg.ExternalPzstd != "" {
+		cfg.ExternalPzstd = ""
+		log.Printf("-max-memory %s: turning off -external-pzstd, which compresses with several threads of its own", formatBytes(budget))
+	}
+	return cfg
+}
+
+// memoryLevel returns the compression level to use for the -max-memory
+// budget: "best" needs the largest window and match tables, so it is lowered
+// to "better" below memoryStreamingOnly.
+func memoryLevel(cfg Config, level string) string {
+	budget := int64(cfg.MaxMemory)
+	if budget == 0 || budget >= memoryStreamingOnly || level != "best" {
+		return level
+	}
+	log.Printf("-max-memory %s: compressing with level 'better' instead of 'best'", formatBytes(budget))
+	return "better"
+}
+
+// encoderMemoryOptions returns the zstd encoder options for the -max-memory
+// budget.
+func encoderMemoryOptions(cfg Config) []zstd.EOption {
+	if !lowMemoryCodecs {
+		return nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1), zstd.WithLowerEncoderMem(true)}
+	if int64(cfg.MaxMemory) < memoryStreamingOnly {
+		opts = append(opts, zstd.WithWindowSize(memoryWindowSize))
+	}
+	return opts
+}
+
+// benchmarkSampleLimit returns how much of the source -benchmark holds in
+// memory: benchmarkSampleBytes, or a quarter of the -max-memory budget if
+// that is less.
+func benchmarkSampleLimit(cfg Config) int {
+	if cfg.MaxMemory > 0 && int64(cfg.MaxMemory)/4 < benchmarkSampleBytes {
+		return int(cfg.MaxMemory / 4)
+	}
+	return benchmarkSampleBytes
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// metadataSuffix is appended to an archive's filename to name its sidecar.
+const metadataSuffix = ".json"
+
+// Metadata is the JSON sidecar written next to an archive with -metadata. It
+// records where the archive came from, which build of the tool created it and
+// the list of entries it contains.
+type Metadata struct {
+	Archive     string          `json:"archive"`
+	Label       string          `json:"label,omitempty"`
+	Created     time.Time       `json:"created"`
+	Source      string          `json:"source"`
+	Hash        string          `json:"hash"`
+	HashAlg     string          `json:"hash_algorithm,omitempty"`
+	SHA256      string          `json:"sha256,omitempty"`
+	Encrypted   bool            `json:"encrypted"`
+	HashStage   string          `json:"hash_stage,omitempty"`
+	Dictionary  string          `json:"dictionary,omitempty"`
+	Size        int64           `json:"size"`
+	Files       int             `json:"files"`
+	Bytes       int64           `json:"bytes"`
+	ToolVersion string          `json:"tool_version"`
+	ToolCommit  string          `json:"tool_commit,omitempty"`
+	Entries     []manifestEntry `json:"entries"`
+}
+
+// manifestEntry is a single tar entry as recorded in the metadata sidecar.
+type manifestEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	Mode    string    `json:"mode"`
+	ModTime time.Time `json:"mtime"`
+	Type    string    `json:"type"`
+}
+
+// newManifestEntry builds a manifest entry from a tar header.
+func newManifestEntry(h *tar.Header) manifestEntry {
+	return manifestEntry{
+		Name:    h.Name,
+		Size:    h.Size,
+		Mode:    h.FileInfo().Mode().String(),
+		ModTime: h.ModTime,
+		Type:    entryType(h.Typeflag),
+	}
+}
+
+// entryType returns a short human readable name for a tar type flag.
+func entryType(flag byte) string {
+	switch flag {
+	case tar.TypeReg:
+		return "file"
+	case tar.TypeGNUSparse:
+		return "sparse"
+	case tar.TypeDir:
+		return "dir"
+	case tar.TypeSymlink:
+		return "symlink"
+	case tar.TypeLink:
+		return "hardlink"
+	case tar.TypeFifo:
+		return "fifo"
+	case tar.TypeChar:
+		return "char"
+	case tar.TypeBlock:
+		return "block"
+	default:
+		return fmt.Sprintf("type-%c", flag)
+	}
+}
+
+// writeMetadata writes the metadata sidecar for arc.
+func writeMetadata(cfg Config, arc *archive) error {
+	v, c := buildInfo()
+	meta := Metadata{
+		Archive:     filepath.Base(arc.Path),
+		Label:       arc.Fields.Label,
+		Created:     time.Now(),
+		Source:      cfg.Source,
+		Hash:        arc.Hash,
+		HashAlg:     cfg.HashAlgorithm,
+		SHA256:      arc.SHA256,
+		Encrypted:   cfg.Passphrase != "",
+		Dictionary:  arc.Dict,
+		Size:        arc.Size,
+		Files:       arc.Files,
+		Bytes:       arc.Bytes,
+		ToolVersion: v,
+		ToolCommit:  c,
+		Entries:     arc.Entries,
+	}
+	if meta.Encrypted {
+		meta.HashStage = cfg.HashStage
+	}
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode metadata: %w", err)
+	}
+	if err := writeFileAtomic(arc.Path+metadataSuffix, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata sidecar: %w", err)
+	}
+	arc.Sidecars = append(arc.Sidecars, arc.Path+metadataSuffix)
+	return nil
+}
+
+// checksumSuffix is appended to an archive's filename to name its SHA-256
+// sidecar.
+const checksumSuffix = ".sha256"
+
+// writeChecksumFile writes the archive's SHA-256 in the format of sha256sum,
+// so the archive can be checked with "sha256sum -c <archive>.sha256". A
+// pre-encrypt hash covers the decrypted archive, so the line names the
+// archive without its .age extension.
+func writeChecksumFile(cfg Config, arc *archive) error {
+	name := filepath.Base(arc.Path)
+	if cfg.Passphrase != "" && cfg.HashStage == hashStagePreEncrypt {
+		name = strings.TrimSuffix(name, encryptedExtension)
+	}
+	line := fmt.Sprintf("%s  %s\n", arc.SHA256, name)
+	if err := writeFileAtomic(arc.Path+checksumSuffix, []byte(line), 0644); err != nil {
+		return fmt.Errorf("failed to write checksum sidecar: %w", err)
+	}
+	arc.Sidecars = append(arc.Sidecars, arc.Path+checksumSuffix)
+	return nil
+}
+
+// readMetadata reads the metadata sidecar of the archive at archivePath.
+func readMetadata(archivePath string) (Metadata, error) {
+	var meta Metadata
+	data, err := os.ReadFile(archivePath + metadataSuffix)
+	if err != nil {
+		return meta, fmt.Errorf("failed to read metadata of '%s': %w", archivePath, err)
+	}
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return meta, fmt.Errorf("failed to parse metadata of '%s': %w", archivePath, err)
+	}
+	return meta, nil
+}
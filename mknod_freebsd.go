@@ -0,0 +1,8 @@
+package main
+
+import "golang.org/x/sys/unix"
+
+// mknod creates a device node; FreeBSD takes the device number as a uint64.
+func mknod(path string, mode uint32, dev uint64) error {
+	return unix.Mknod(path, mode, dev)
+}
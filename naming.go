@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// archiveExtension is the default suffix of archives created by this tool.
+// -extension replaces it.
+const archiveExtension = ".tar.zstd"
+
+// archiveExtensions are the extensions parseArchiveName accepts. The default
+// is always included so archives made before -extension was changed are
+// still listed and pruned.
+var archiveExtensions = []string{archiveExtension}
+
+// extensionPattern matches a sane -extension value such as .tzst or .tar.zst.
+var extensionPattern = regexp.MustCompile(`^(\.[A-Za-z0-9]+)+$`)
+
+// checkExtension validates an -extension value. Extensions that end like a
+// sidecar or an encrypted archive are rejected, as they would be mistaken
+// for one.
+func checkExtension(ext string) error {
+	if len(ext) > 32 || !extensionPattern.MatchString(ext) {
+		return fmt.Errorf("invalid extension '%s', expected something like .tar.zstd or .tzst", ext)
+	}
+	for _, suffix := range []string{metadataSuffix, checksumSuffix, signatureSuffix, keepSuffix, encryptedExtension} {
+		if strings.HasSuffix(ext, suffix) {
+			return fmt.Errorf("invalid extension '%s', it must not end in %s", ext, suffix)
+		}
+	}
+	return nil
+}
+
+// nameFields are the values an archive's name is built from. They are also
+// exposed to -remote-prefix-template, e.g. "{{.Year}}/{{.Month}}/".
+type nameFields struct {
+	Label string // -label slug, empty for unlabeled archives
+	Date  string // mm-dd-yyyy
+	Year  string // yyyy
+	Month string // mm
+	Day   string // dd
+	Hash  string // hex digest of the archive
+	Ext   string // file extension including the leading dot, e.g. .tar.zstd.age
+}
+
+// newNameFields returns the name fields for an archive created at t with the
+// given hash and extension.
+func newNameFields(t time.Time, hash, ext string) nameFields {
+	return nameFields{
+		Date:  t.Format("01-02-2006"),
+		Year:  t.Format("2006"),
+		Month: t.Format("01"),
+		Day:   t.Format("02"),
+		Hash:  hash,
+		Ext:   ext,
+	}
+}
+
+// filename returns the archive's filename: mm-dd-yyyy-hash.tar.zstd, with .age
+// appended for encrypted archives and the label in front of labeled ones,
+// e.g. pre-upgrade-mm-dd-yyyy-hash.tar.zstd.
+func (f nameFields) filename() string {
+	if f.Label != "" {
+		return fmt.Sprintf("%s-%s-%s%s", f.Label, f.Date, f.Hash, f.Ext)
+	}
+	return fmt.Sprintf("%s-%s%s", f.Date, f.Hash, f.Ext)
+}
+
+// archiveNamePattern matches the filenames produced by nameFields.filename.
+var archiveNamePattern = regexp.MustCompile(`^(?:([a-z0-9]+(?:-[a-z0-9]+)*)-)??((\d{2})-(\d{2})-(\d{4}))-([0-9a-f]+)(\..+)$`)
+
+// maxLabelLength caps the length of a -label slug.
+const maxLabelLength = 40
+
+// labelUnsafe matches the runs of characters sanitizeLabel replaces.
+var labelUnsafe = regexp.MustCompile(`[^a-z0-9]+`)
+
+// sanitizeLabel turns a -label value into the slug put in front of archive
+// names: lower case letters and digits, with every other run of characters
+// replaced by a single dash, and at most maxLabelLength long.
+func sanitizeLabel(label string) (string, error) {
+	slug := strings.Trim(labelUnsafe.ReplaceAllString(strings.ToLower(label), "-"), "-")
+	if len(slug) > maxLabelLength {
+		slug = strings.TrimRight(slug[:maxLabelLength], "-")
+	}
+	if slug == "" {
+		return "", fmt.Errorf("invalid -label '%s', it must contain letters or digits", label)
+	}
+	return slug, nil
+}
+
+// parseArchiveName recovers the name fields from an archive's filename. It
+// returns false for files that are not archives, such as sidecars.
+func parseArchiveName(name string) (nameFields, bool) {
+	m := archiveNamePattern.FindStringSubmatch(name)
+	if m == nil || !slices.Contains(archiveExtensions, strings.TrimSuffix(m[7], encryptedExtension)) {
+		return nameFields{}, false
+	}
+	return nameFields{Label: m[1], Date: m[2], Month: m[3], Day: m[4], Year: m[5], Hash: m[6], Ext: m[7]}, true
+}
+
+// countArchivesOn counts the archives in dir whose filename carries the given
+// mm-dd-yyyy date, not counting those in trash. A -stream-split archive is
+// only stored as its manifest, which counts as the archive.
+func countArchivesOn(dir, trash, date string) (int, error) {
+	count := 0
+	err := walkArchiveDirs(dir, trash, func(path string, entry fs.DirEntry) error {
+		name := strings.TrimSuffix(entry.Name(), splitManifestSuffix)
+		if fields, ok := parseArchiveName(name); ok && fields.Date == date {
+			count++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to read target directory '%s': %w", dir, err)
+	}
+	return count, nil
+}
+
+// parsePrefixTemplate parses a -remote-prefix-template value.
+func parsePrefixTemplate(text string) (*template.Template, error) {
+	tmpl, err := template.New("remote-prefix").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid remote prefix template '%s': %w", text, err)
+	}
+	return tmpl, nil
+}
+
+// renderPrefix renders a remote prefix template for the given fields. The
+// result never starts with a slash and, unless empty, always ends with one.
+func renderPrefix(tmpl *template.Template, f nameFields) (string, error) {
+	if tmpl == nil {
+		return "", nil
+	}
+	var sb strings.Builder
+	if err := tmpl.Execute(&sb, f); err != nil {
+		return "", fmt.Errorf("failed to render remote prefix template: %w", err)
+	}
+	prefix := strings.Trim(sb.String(), "/")
+	if prefix == "" {
+		return "", nil
+	}
+	return prefix + "/", nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCountArchivesOn(t *testing.T) {
+	target := t.TempDir()
+	writeFiles(t, target, map[string]string{
+		"06-01-2024-1a2b3c4d.tar.zstd":                        "archive",
+		"06-01-2024-1a2b3c4d.tar.zstd.json":                   "sidecar",
+		"2024/06/06-01-2024-5e6f7a8b.tar.zstd.parts.json":     "split manifest",
+		"06-01-2024-split-9c0d1e2f.tar.zstd.0001":             "part",
+		"05-31-2024-3c4d5e6f.tar.zstd":                        "archive of another day",
+		".trash/20240601-000000/06-01-2024-7a8b9c0d.tar.zstd": "trashed archive",
+	})
+	count, err := countArchivesOn(target, filepath.Join(target, trashDirName), "06-01-2024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 2 {
+		t.Errorf("counted %d archives on 06-01-2024, want 2, one of them split", count)
+	}
+}
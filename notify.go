@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// notification is the JSON payload posted to the notify webhook.
+type notification struct {
+	Status  string    `json:"status"`
+	Message string    `json:"message"`
+	Source  string    `json:"source"`
+	Archive string    `json:"archive,omitempty"`
+	Time    time.Time `json:"time"`
+	Result  Result    `json:"result"`
+	// LargestFiles is set with -notify-include-toc. TOCTruncated reports
+	// that fewer files than requested were included to keep the payload
+	// small.
+	LargestFiles []tocEntry `json:"largest_files,omitempty"`
+	TOCTruncated bool       `json:"toc_truncated,omitempty"`
+}
+
+// tocEntry is a file listed in a notification.
+type tocEntry struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// Limits that keep -notify-include-toc payloads within what webhooks and
+// mail gateways accept.
+const (
+	notifyTOCMaxBytes = 16 << 10
+	notifyTOCMaxName  = 200
+)
+
+// largestFiles returns up to n of the largest regular files in entries,
+// largest first. Long names are shortened and the list is cut off once it
+// would exceed notifyTOCMaxBytes; truncated reports whether that happened.
+func largestFiles(entries []manifestEntry, n int) (toc []tocEntry, truncated bool) {
+	var files []manifestEntry
+	for _, e := range entries {
+		if e.Type == "file" {
+			files = append(files, e)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool { return files[i].Size > files[j].Size })
+	budget := notifyTOCMaxBytes
+	for _, e := range files {
+		if len(toc) == n {
+			break
+		}
+		name := e.Name
+		if len(name) > notifyTOCMaxName {
+			name = "..." + name[len(name)-notifyTOCMaxName+3:]
+		}
+		if budget -= len(name) + 40; budget < 0 {
+			return toc, true
+		}
+		toc = append(toc, tocEntry{Name: name, Size: e.Size})
+	}
+	return toc, false
+}
+
+// notifyResult sends a notification for the outcome of a run if a webhook is
+// configured. Failures are always sent. Success notifications are throttled to
+// at most one per cfg.NotifyThrottle, tracked in the target directory's state
+// file so the limit holds across separate one-shot invocations.
+// Notification problems are logged and never fail the backup itself.
+//
+// With -notify-include-toc, the largest files of the archive, which may be
+// nil if the run failed before creating it, are listed in the payload. With
+// -notify-transitions failures go through notifyTransition instead.
+func notifyResult(cfg Config, res Result, arc *archive) {
+	if cfg.NotifyURL == "" {
+		return
+	}
+
+	now := time.Now()
+	n := notification{
+		Status:  "success",
+		Message: "Backup completed successfully",
+		Source:  cfg.Source,
+		Archive: res.Archive,
+		Time:    now,
+		Result:  res,
+	}
+	if cfg.NotifyIncludeTOC > 0 && arc != nil {
+		n.LargestFiles, n.TOCTruncated = largestFiles(arc.Entries, cfg.NotifyIncludeTOC)
+	}
+	if !res.Success {
+		n.Status = "failure"
+		n.Message = res.Error
+	}
+	if cfg.NotifyTransitions && notifyTransition(cfg, n) {
+		return
+	}
+	if !res.Success {
+		if err := sendNotification(cfg.NotifyURL, n); err != nil {
+			log.Printf("Error sending failure notification: %v", err)
+		}
+		return
+	}
+
+	state, err := loadState(cfg.Target)
+	if err != nil {
+		log.Printf("Warning: %v, sending notification anyway", err)
+	}
+	if cfg.NotifyThrottle > 0 && now.Sub(state.LastSuccessNotify) < cfg.NotifyThrottle {
+		if cfg.Verbose == true {
+			log.Printf("Skipping success notification, last one sent at %s", state.LastSuccessNotify.Format(time.RFC3339))
+		}
+		return
+	}
+	if err := sendNotification(cfg.NotifyURL, n); err != nil {
+		log.Printf("Error sending success notification: %v", err)
+		return
+	}
+	state.LastSuccessNotify = now
+	if err := saveState(cfg.Target, state); err != nil {
+		log.Printf("Warning: could not record notification time: %v", err)
+	}
+}
+
+// notifyTransition implements -notify-transitions: of a series of failed
+// runs only the first is notified, and the first run that succeeds after them
+// sends a "recovered" notification regardless of -notify-throttle. The series
+// is tracked in the state file, so it continues across restarts. It reports
+// whether the notification was handled; other successes are left to the
+// usual throttled notification.
+func notifyTransition(cfg Config, n notification) bool {
+	state, err := loadState(cfg.Target)
+	if err != nil {
+		log.Printf("Warning: %v, sending notification anyway", err)
+		return false
+	}
+	if n.Status == "failure" {
+		state.FailedRuns++
+		if state.FailedRuns == 1 {
+			state.FailingSince = n.Time
+		}
+		if state.FailureNotified {
+			if cfg.Verbose == true {
+				log.Printf("Skipping failure notification, backups have been failing since %s (%d runs)", state.FailingSince.Format(time.RFC3339), state.FailedRuns)
+			}
+		} else if err := sendNotification(cfg.NotifyURL, n); err != nil {
+			log.Printf("Error sending failure notification: %v", err)
+		} else {
+			state.FailureNotified = true
+		}
+	} else {
+		if state.FailedRuns == 0 {
+			return false
+		}
+		n.Status = "recovered"
+		n.Message = fmt.Sprintf("Backup completed successfully again after %d failed runs since %s", state.FailedRuns, state.FailingSince.Format(time.RFC3339))
+		if err := sendNotification(cfg.NotifyURL, n); err != nil {
+			log.Printf("Error sending recovery notification: %v", err)
+			return true
+		}
+		state.FailedRuns, state.FailingSince, state.FailureNotified = 0, time.Time{}, false
+		state.LastSuccessNotify = n.Time
+	}
+	if err := saveState(cfg.Target, state); err != nil {
+		log.Printf("Warning: could not record the failure state for -notify-transitions: %v", err)
+	}
+	return true
+}
+
+// sendNotification posts the payload as JSON to the webhook URL.
+func sendNotification(url string, n notification) error {
+	body, err := json.Marshal(n)
+	if err != nil {
+		return fmt.Errorf("failed to encode notification: %w", err)
+	}
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to post notification: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("notification webhook returned status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// errRoundtripAborted stops the -paranoid verifier when the backup fails for
+// another reason.
+var errRoundtripAborted = errors.New("backup aborted")
+
+// roundtripEntry is the name and content digest of one tar entry.
+type roundtripEntry struct {
+	name   string
+	digest [sha256.Size]byte
+}
+
+// roundtripVerifier implements -paranoid. The compressed stream is teed into
+// it as it is produced, and a goroutine decompresses it again and hashes every
+// entry. Each entry is matched against the SHA-256 of the data that was read
+// for it, so the archive is known to decode correctly before it is finalized.
+// Only the data in flight is held in memory.
+//
+// Neither side waits for the other: the decoder may hand out an entry's
+// content before the writer has finished the write that carried it, so
+// entries are compared as soon as both sides have recorded them.
+type roundtripVerifier struct {
+	pr   *io.PipeReader
+	pw   *io.PipeWriter
+	done chan error
+
+	mu      sync.Mutex
+	written []roundtripEntry
+	decoded []roundtripEntry
+	checked int
+	err     error
+}
+
+func newRoundtripVerifier() *roundtripVerifier {
+	pr, pw := io.Pipe()
+	v := &roundtripVerifier{pr: pr, pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := v.run()
+		if err != nil {
+			v.fail(err)
+		}
+		v.done <- err
+	}()
+	return v
+}
+
+// Write receives the compressed stream.
+func (v *roundtripVerifier) Write(p []byte) (int, error) {
+	return v.pw.Write(p)
+}
+
+// expect records the content digest of the next entry written to the
+// archive, nil for entries without content.
+func (v *roundtripVerifier) expect(name string, digest []byte) {
+	entry := roundtripEntry{name: name, digest: sha256.Sum256(nil)}
+	copy(entry.digest[:], digest)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.written = append(v.written, entry)
+	v.compareLocked()
+}
+
+// fail records the first error and makes further writes to the stream fail
+// with it, which stops the backup.
+func (v *roundtripVerifier) fail(err error) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err == nil {
+		v.err = err
+	}
+	v.pr.CloseWithError(v.err)
+}
+
+// compareLocked checks the entries recorded by both sides so far.
+func (v *roundtripVerifier) compareLocked() {
+	for v.err == nil && v.checked < len(v.written) && v.checked < len(v.decoded) {
+		want, got := v.written[v.checked], v.decoded[v.checked]
+		if want.name != got.name || !bytes.Equal(want.digest[:], got.digest[:]) {
+			v.err = fmt.Errorf("roundtrip check failed: entry '%s' does not decode to the data written for '%s'", got.name, want.name)
+			v.pr.CloseWithError(v.err)
+		}
+		v.checked++
+	}
+}
+
+func (v *roundtripVerifier) run() error {
+	decoder, err := zstd.NewReader(v.pr, decoderOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer decoder.Close()
+	tarReader := tar.NewReader(decoder)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			// Drain the rest of the stream, such as a seek table.
+			_, err = io.Copy(io.Discard, v.pr)
+			return err
+		}
+		if err != nil {
+			return fmt.Errorf("roundtrip check failed: could not decode archive: %w", err)
+		}
+		hasher := sha256.New()
+		if _, err := io.Copy(hasher, tarReader); err != nil {
+			return fmt.Errorf("roundtrip check failed: could not decode '%s': %w", header.Name, err)
+		}
+		entry := roundtripEntry{name: header.Name}
+		hasher.Sum(entry.digest[:0])
+		v.mu.Lock()
+		v.decoded = append(v.decoded, entry)
+		v.compareLocked()
+		v.mu.Unlock()
+	}
+}
+
+// finish waits for the verifier to check the complete stream. It must be
+// called after the compressor has been closed.
+func (v *roundtripVerifier) finish() error {
+	if err := v.stop(nil); err != nil {
+		return err
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.err == nil && len(v.decoded) != len(v.written) {
+		return fmt.Errorf("roundtrip check failed: %d entries were written but %d decode", len(v.written), len(v.decoded))
+	}
+	return v.err
+}
+
+// abort stops the verifier without checking the rest of the stream.
+func (v *roundtripVerifier) abort() {
+	v.stop(errRoundtripAborted)
+}
+
+func (v *roundtripVerifier) stop(reason error) error {
+	if v.done == nil {
+		return nil
+	}
+	v.pw.CloseWithError(reason) // nil closes with io.EOF
+	err := <-v.done
+	v.done = nil
+	if errors.Is(err, errRoundtripAborted) {
+		return nil
+	}
+	return err
+}
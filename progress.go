@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often -progress logs a line.
+const progressInterval = 10 * time.Second
+
+// progress periodically logs the files and bytes processed so far by a
+// backup or restore, with the percentage done when the total is known.
+type progress struct {
+	label string
+	total int64 // expected bytes, 0 if unknown
+	start time.Time
+	files atomic.Int64
+	bytes atomic.Int64
+	done  chan struct{}
+}
+
+// startProgress starts logging progress for label every progressInterval
+// until stop is called.
+func startProgress(label string, total int64) *progress {
+	p := &progress{label: label, total: total, start: time.Now(), done: make(chan struct{})}
+	go func() {
+		ticker := time.NewTicker(progressInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.report()
+			case <-p.done:
+				return
+			}
+		}
+	}()
+	return p
+}
+
+// stop ends the periodic reporting and logs a final line.
+func (p *progress) stop() {
+	close(p.done)
+	p.report()
+}
+
+// fileDone counts a finished file.
+func (p *progress) fileDone() { p.files.Add(1) }
+
+func (p *progress) report() {
+	bytes := p.bytes.Load()
+	line := fmt.Sprintf("%s progress: %d files, %s", p.label, p.files.Load(), formatBytes(bytes))
+	if p.total > 0 {
+		line += fmt.Sprintf(" of %s (%.0f%%)", formatBytes(p.total), 100*float64(min(bytes, p.total))/float64(p.total))
+	}
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		line += fmt.Sprintf(", %s/s", formatBytes(int64(float64(bytes)/elapsed)))
+	}
+	log.Print(line)
+}
+
+// writer wraps w so that everything written through it is counted.
+func (p *progress) writer(w io.Writer) io.Writer {
+	return progressWriter{w: w, p: p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *progress
+}
+
+func (pw progressWriter) Write(b []byte) (int, error) {
+	n, err := pw.w.Write(b)
+	pw.p.bytes.Add(int64(n))
+	return n, err
+}
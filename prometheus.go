@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// lastSuccessMetric is carried over from the previous textfile when a run
+// fails, so it keeps pointing at the last run that actually succeeded.
+const lastSuccessMetric = "vwbackup_last_success_timestamp"
+
+// writePromTextfile writes the result as metrics for node_exporter's textfile
+// collector. The file is replaced atomically so node_exporter never reads a
+// partially written file.
+func writePromTextfile(path string, r Result) error {
+	lastSuccess := previousLastSuccess(path)
+	success := 0
+	if r.Success {
+		success = 1
+		lastSuccess = float64(r.Finished.Unix())
+	}
+
+	var buf bytes.Buffer
+	metric := func(name, help string, value float64) {
+		fmt.Fprintf(&buf, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n",
+			name, help, name, name, strconv.FormatFloat(value, 'f', -1, 64))
+	}
+	metric("vwbackup_last_run_timestamp", "Unix time the last backup run finished.", float64(r.Finished.Unix()))
+	metric("vwbackup_last_run_success", "Whether the last backup run succeeded (1) or failed (0).", float64(success))
+	metric(lastSuccessMetric, "Unix time the last successful backup run finished.", lastSuccess)
+	metric("vwbackup_duration_seconds", "Duration of the last backup run in seconds.", r.DurationSeconds)
+	metric("vwbackup_archive_bytes", "Size of the last archive on disk in bytes.", float64(r.ArchiveBytes))
+	metric("vwbackup_source_bytes", "Uncompressed size of the files in the last archive in bytes.", float64(r.Bytes))
+	metric("vwbackup_files", "Number of files in the last archive.", float64(r.Files))
+
+	if err := writeFileAtomic(path, buf.Bytes(), 0644); err != nil {
+		return fmt.Errorf("failed to write prometheus textfile: %w", err)
+	}
+	return nil
+}
+
+// previousLastSuccess reads lastSuccessMetric from an existing textfile, or
+// returns 0 if there is none.
+func previousLastSuccess(path string) float64 {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == lastSuccessMetric {
+			if v, err := strconv.ParseFloat(fields[1], 64); err == nil {
+				return v
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// storedArchive is an archive found in the target directory.
+type storedArchive struct {
+	Path         string
+	Date         time.Time // date from the filename
+	Label        string    // -label from the filename, if any
+	Keep         bool      // a keepSuffix marker is next to it
+	InLabeledDir bool      // stored in labeled/<label> by -organize-labeled
+	ModTime      time.Time
+	Size         int64
+}
+
+// keepSuffix is the suffix of the marker file that protects the archive it
+// is named after from every kind of pruning, e.g. archive.tar.zstd.keep. Its
+// content does not matter.
+const keepSuffix = ".keep"
+
+// listArchives returns the archives in dir and its yyyy/mm subdirectories
+// (see -organize), oldest first, leaving out the trash (see trashMatcher).
+// Archives are ordered by the date in their filename and, within a day, by
+// modification time.
+func listArchives(dir, trash string) ([]storedArchive, error) {
+	var archives []storedArchive
+	err := walkArchiveDirs(dir, trash, func(path string, entry fs.DirEntry) error {
+		fields, ok := parseArchiveName(entry.Name())
+		if !ok {
+			return nil
+		}
+		date, err := time.Parse("01-02-2006", fields.Date)
+		if err != nil {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return fmt.Errorf("failed to stat archive '%s': %w", path, err)
+		}
+		_, err = os.Stat(path + keepSuffix)
+		rel, _ := filepath.Rel(dir, path)
+		archives = append(archives, storedArchive{
+			Path:         path,
+			Date:         date,
+			Label:        fields.Label,
+			Keep:         err == nil,
+			InLabeledDir: strings.HasPrefix(filepath.ToSlash(rel), labeledDirName+"/"),
+			ModTime:      info.ModTime(),
+			Size:         info.Size(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read target directory '%s': %w", dir, err)
+	}
+	sort.Slice(archives, func(i, j int) bool {
+		if !archives[i].Date.Equal(archives[j].Date) {
+			return archives[i].Date.Before(archives[j].Date)
+		}
+		return archives[i].ModTime.Before(archives[j].ModTime)
+	})
+	return archives, nil
+}
+
+// walkArchiveDirs calls fn for every regular file in dir and its yyyy/mm
+// subdirectories, the directories archives are stored in, leaving out the
+// trash. A missing dir holds no files.
+func walkArchiveDirs(dir, trash string, fn func(path string, entry fs.DirEntry) error) error {
+	isTrash := trashMatcher(trash)
+	return filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if path == dir && errors.Is(err, fs.ErrNotExist) {
+				return fs.SkipAll
+			}
+			return err
+		}
+		if entry.IsDir() {
+			if path != dir && isTrash(entry) {
+				return filepath.SkipDir
+			}
+			if rel, _ := filepath.Rel(dir, path); strings.Count(rel, string(filepath.Separator)) >= 2 {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !entry.Type().IsRegular() {
+			return nil
+		}
+		return fn(path, entry)
+	})
+}
+
+// archiveSidecarSuffixes are the suffixes of the files that may be written
+// next to an archive and are removed along with it.
+var archiveSidecarSuffixes = []string{metadataSuffix, checksumSuffix, signatureSuffix, metadataSuffix + signatureSuffix}
+
+// prunable returns the archives retention may remove, oldest first: all but
+// those with a keepSuffix marker, those in the labeled/ directory of
+// -organize-labeled and, with protectLabeled, those with a -label. Protected
+// archives do not count towards -keep or -keep-min either, so the routine
+// archives keep rotating next to them.
+func prunable(archives []storedArchive, protectLabeled, verbose bool) []storedArchive {
+	var candidates []storedArchive
+	for _, a := range archives {
+		switch {
+		case a.Keep:
+			if verbose == true {
+				log.Printf("Not pruning '%s', it has a %s marker", a.Path, keepSuffix)
+			}
+		case a.InLabeledDir:
+			if verbose == true {
+				log.Printf("Not pruning '%s', it is in the %s/ directory", a.Path, labeledDirName)
+			}
+		case protectLabeled && a.Label != "":
+			if verbose == true {
+				log.Printf("Not pruning '%s', it is labeled '%s'", a.Path, a.Label)
+			}
+		default:
+			candidates = append(candidates, a)
+		}
+	}
+	return candidates
+}
+
+// removeArchive deletes an archive and its sidecars and returns the number of
+// bytes freed.
+func removeArchive(a storedArchive) (int64, error) {
+	if err := os.Remove(a.Path); err != nil {
+		return 0, fmt.Errorf("failed to remove archive '%s': %w", a.Path, err)
+	}
+	freed := a.Size
+	for _, suffix := range archiveSidecarSuffixes {
+		sidecar := a.Path + suffix
+		info, err := os.Stat(sidecar)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err := os.Remove(sidecar); err != nil {
+			return freed, fmt.Errorf("failed to remove '%s': %w", sidecar, err)
+		}
+		freed += info.Size()
+	}
+	return freed, nil
+}
+
+// PruneBackups removes the oldest archives in dir so that at most keep
+// remain, leaving the archives protected as described by prunable out of the
+// count. It returns the paths removed and the bytes freed. If trash is not
+// empty, archives are moved into that directory instead of being deleted,
+// and the bytes returned are the bytes moved.
+func PruneBackups(dir string, keep int, trash string, protectLabeled, verbose bool) ([]string, int64, error) {
+	archives, err := listArchives(dir, trash)
+	if err != nil {
+		return nil, 0, err
+	}
+	archives = prunable(archives, protectLabeled, verbose)
+	var removed []string
+	var freed int64
+	for len(archives) > keep {
+		var n int64
+		if trash != "" {
+			n, err = moveToTrash(archives[0], trash)
+		} else {
+			n, err = removeArchive(archives[0])
+		}
+		freed += n
+		if err != nil {
+			return removed, freed, err
+		}
+		removed = append(removed, archives[0].Path)
+		removeEmptyParents(filepath.Dir(archives[0].Path), dir)
+		if trash != "" {
+			log.Printf("Moved old archive to trash: %s", archives[0].Path)
+		} else if archives[0].Label != "" {
+			log.Printf("Pruned old archive labeled '%s': %s", archives[0].Label, archives[0].Path)
+		} else if verbose == true {
+			log.Printf("Pruned old archive: %s", archives[0].Path)
+		}
+		archives = archives[1:]
+	}
+	return removed, freed, nil
+}
+
+// ensureFreeSpace checks that the target directory has at least -min-free
+// bytes available. With -prune-to-free, old archives are removed first,
+// oldest first, until enough space is available; the newest -keep-min
+// archives, and at least one, are never removed this way, and neither are
+// protected ones.
+func ensureFreeSpace(cfg Config, res *Result) error {
+	if err := os.MkdirAll(cfg.Target, 0755); err != nil {
+		return fmt.Errorf("failed to create target directory '%s': %w", cfg.Target, err)
+	}
+	free, err := freeSpace(cfg.Target)
+	if err != nil {
+		return err
+	}
+	need := uint64(cfg.MinFree)
+	if free < need && cfg.PruneToFree {
+		archives, err := listArchives(cfg.Target, trashDir(cfg))
+		if err != nil {
+			return err
+		}
+		archives = prunable(archives, cfg.PruneProtectLabeled, cfg.Verbose)
+		var freed int64
+		for len(archives) > max(cfg.KeepMin, 1) && free < need {
+			n, err := removeArchive(archives[0])
+			freed += n
+			if err != nil {
+				return err
+			}
+			res.Pruned = append(res.Pruned, archives[0].Path)
+			removeEmptyParents(filepath.Dir(archives[0].Path), cfg.Target)
+			if cfg.Verbose == true {
+				log.Printf("Pruned old archive to free space: %s", archives[0].Path)
+			}
+			archives = archives[1:]
+			if free, err = freeSpace(cfg.Target); err != nil {
+				return err
+			}
+		}
+		if len(res.Pruned) > 0 {
+			log.Printf("Pruned %d old archives, freed %s", len(res.Pruned), formatBytes(freed))
+			refreshLatestLink(cfg)
+		}
+	}
+	if free < need {
+		return fmt.Errorf("only %s free in '%s', -min-free requires %s",
+			formatBytes(int64(free)), cfg.Target, formatBytes(int64(need)))
+	}
+	return nil
+}
+
+// dirSize returns the total size of the regular files below dir. A trash
+// inside dir is included, since it takes up space on the same disk.
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.Type().IsRegular() {
+			info, err := entry.Info()
+			if err != nil {
+				return err
+			}
+			size += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to measure target directory '%s': %w", dir, err)
+	}
+	return size, nil
+}
+
+// enforceQuota removes the oldest archives until everything in the target
+// directory fits in -target-quota, but never removes the newest -keep-min
+// archives, at least the one just written, or protected ones. It runs after
+// the new archive was written, so the directory may exceed the quota by one
+// archive while a backup is running.
+func enforceQuota(cfg Config, res *Result) error {
+	quota := int64(cfg.TargetQuota)
+	used, err := dirSize(cfg.Target)
+	if err != nil {
+		return err
+	}
+	if used <= quota {
+		return nil
+	}
+	archives, err := listArchives(cfg.Target, trashDir(cfg))
+	if err != nil {
+		return err
+	}
+	archives = prunable(archives, cfg.PruneProtectLabeled, cfg.Verbose)
+	var pruned int
+	var freed int64
+	for len(archives) > max(cfg.KeepMin, 1) && used > quota {
+		n, err := removeArchive(archives[0])
+		freed += n
+		used -= n
+		if err != nil {
+			return err
+		}
+		pruned++
+		res.Pruned = append(res.Pruned, archives[0].Path)
+		removeEmptyParents(filepath.Dir(archives[0].Path), cfg.Target)
+		if cfg.Verbose == true {
+			log.Printf("Pruned old archive to stay within quota: %s", archives[0].Path)
+		}
+		archives = archives[1:]
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d old archives to stay within -target-quota, freed %s", pruned, formatBytes(freed))
+		refreshLatestLink(cfg)
+	}
+	if used > quota {
+		log.Printf("Warning: target directory uses %s, more than -target-quota %s, but only %d archives that may be pruned are left (-keep-min %d)",
+			formatBytes(used), formatBytes(quota), len(archives), cfg.KeepMin)
+	}
+	return nil
+}
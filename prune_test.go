@@ -0,0 +1,81 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListArchivesSkipsTrash(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"config.json": "{}"})
+	target := t.TempDir()
+	cfg := testConfig(source, target)
+	arc, err := createTarball(cfg, sourceSize{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(arc.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, trash := range []string{filepath.Join(target, trashDirName), filepath.Join(target, "old-backups")} {
+		t.Run(filepath.Base(trash), func(t *testing.T) {
+			cfg.TrashDir = trash
+			// A copy of the archive moved to the trash, as -prune-to-trash
+			// leaves it.
+			trashed := filepath.Join(trash, "20240101-000000", filepath.Base(arc.Path))
+			if err := os.MkdirAll(filepath.Dir(trashed), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(trashed, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(trash)
+
+			archives, err := listArchives(target, trashDir(cfg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(archives) != 1 || archives[0].Path != arc.Path {
+				t.Errorf("listed %d archives, want only %s", len(archives), arc.Path)
+			}
+			// The trash still takes up space in the target.
+			size, err := dirSize(target)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if size != 2*int64(len(data)) {
+				t.Errorf("dirSize = %d, want %d with the trash", size, 2*len(data))
+			}
+		})
+	}
+}
+
+func TestEnforceQuotaKeepsNewest(t *testing.T) {
+	source := t.TempDir()
+	cfg := testConfig(source, t.TempDir())
+	cfg.TargetQuota = 1
+	cfg.KeepMin = 0
+	var paths []string
+	for _, content := range []string{"first", "second"} {
+		writeFiles(t, source, map[string]string{"config.json": content})
+		arc, err := createTarball(cfg, sourceSize{}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, arc.Path)
+	}
+
+	var res Result
+	if err := enforceQuota(cfg, &res); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(paths[1]); err != nil {
+		t.Errorf("the newest archive was pruned with -keep-min 0: %v", err)
+	}
+	if _, err := os.Stat(paths[0]); err == nil {
+		t.Errorf("the older archive was kept although the target is over quota")
+	}
+}
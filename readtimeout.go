@@ -0,0 +1,118 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// errReadTimeout is returned by a timeoutReader once its deadline has passed.
+var errReadTimeout = errors.New("read timed out")
+
+// timeoutReader bounds the total time spent reading a file. Each Read runs in
+// a goroutine so that a read stuck in the kernel (e.g. on a hung NFS or SMB
+// mount) cannot block the backup; the stuck goroutine is abandoned and ends
+// whenever the read finally returns or the file is closed.
+type timeoutReader struct {
+	r        io.Reader
+	deadline time.Time
+	pending  chan readResult // result of an abandoned read, if any
+}
+
+type readResult struct {
+	buf []byte
+	err error
+}
+
+func newTimeoutReader(r io.Reader, timeout time.Duration) *timeoutReader {
+	return &timeoutReader{r: r, deadline: time.Now().Add(timeout)}
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	if t.pending != nil {
+		return 0, errReadTimeout
+	}
+	remaining := time.Until(t.deadline)
+	if remaining <= 0 {
+		return 0, errReadTimeout
+	}
+	// The goroutine reads into its own buffer, since p must not be written
+	// to after Read has returned.
+	done := make(chan readResult, 1)
+	go func() {
+		buf := make([]byte, len(p))
+		n, err := t.r.Read(buf)
+		done <- readResult{buf: buf[:n], err: err}
+	}()
+	timer := time.NewTimer(remaining)
+	defer timer.Stop()
+	select {
+	case res := <-done:
+		return copy(p, res.buf), res.err
+	case <-timer.C:
+		t.pending = done
+		return 0, errReadTimeout
+	}
+}
+
+// copyWithTimeout copies size bytes of a file's content from r to w. With a
+// positive timeout the copy is aborted once it takes longer than that. If
+// padOnTimeout is set, a timed out copy is completed with zeros so the tar
+// entry keeps its declared size, and timedOut is reported instead of an error.
+func copyWithTimeout(w io.Writer, r io.Reader, size int64, timeout time.Duration, padOnTimeout bool) (timedOut bool, err error) {
+	if timeout <= 0 {
+		_, err := io.Copy(w, r)
+		return false, err
+	}
+	written, err := io.Copy(w, newTimeoutReader(r, timeout))
+	if !errors.Is(err, errReadTimeout) {
+		return false, err
+	}
+	if !padOnTimeout {
+		return true, fmt.Errorf("no complete read within %s", timeout)
+	}
+	if _, err := io.CopyN(w, zeroReader{}, size-written); err != nil {
+		return true, err
+	}
+	return true, nil
+}
+
+// readErrorReader counts the bytes read from r and records the first read
+// error, so a failed copy can tell reading from writing errors apart. A read
+// abandoned by a timeoutReader may still finish while the copy is looked at,
+// so the counts are guarded and only read through readState.
+type readErrorReader struct {
+	r   io.Reader
+	mu  sync.Mutex
+	n   int64
+	err error
+}
+
+func (e *readErrorReader) Read(p []byte) (int, error) {
+	n, err := e.r.Read(p)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.n += int64(n)
+	if err != nil && err != io.EOF && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// readState returns the number of bytes read so far and the first read
+// error.
+func (e *readErrorReader) readState() (int64, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.n, e.err
+}
+
+// zeroReader is an endless stream of zero bytes.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+// stuckReader returns err from its first Read once release is closed, like a
+// read from a hung network mount that eventually fails.
+type stuckReader struct {
+	release chan struct{}
+	err     error
+}
+
+func (s *stuckReader) Read(p []byte) (int, error) {
+	<-s.release
+	return len(p) / 2, s.err
+}
+
+func TestCopyWithTimeoutAbandonedRead(t *testing.T) {
+	stuck := &stuckReader{release: make(chan struct{}), err: errors.New("I/O error")}
+	content := &readErrorReader{r: stuck}
+	var out bytes.Buffer
+	timedOut, err := copyWithTimeout(&out, content, 1024, 10*time.Millisecond, true)
+	if err != nil || !timedOut {
+		t.Fatalf("copyWithTimeout = %v, %v, want a timeout without an error", timedOut, err)
+	}
+	if out.Len() != 1024 {
+		t.Errorf("timed out copy wrote %d bytes, want it padded to 1024", out.Len())
+	}
+
+	// The abandoned read finishing while the copy is inspected must not
+	// race with it, which go test -race checks.
+	close(stuck.release)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		if _, readErr := content.readState(); readErr != nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("the error of the abandoned read was never recorded")
+		}
+	}
+}
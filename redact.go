@@ -0,0 +1,91 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces secret values in output meant to be shared.
+const redacted = "REDACTED"
+
+// redactURL masks the credential-bearing parts of a URL: the password in its
+// user info and the values of its query parameters, which often carry tokens.
+// For http and https URLs every path segment is masked as well, since
+// webhooks such as Slack's /services/T/B/token and Discord's
+// /api/webhooks/id/token keep their secret in the path. Strings that are not
+// URLs are returned unchanged.
+func redactURL(s string) string {
+	if !strings.Contains(s, "://") {
+		return s
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return s
+	}
+	changed := false
+	if u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+			changed = true
+		}
+	}
+	if (u.Scheme == "http" || u.Scheme == "https") && strings.Trim(u.Path, "/") != "" {
+		segments := strings.Split(u.Path, "/")
+		for i, segment := range segments {
+			if segment != "" {
+				segments[i] = redacted
+			}
+		}
+		u.Path = strings.Join(segments, "/")
+		u.RawPath = ""
+		changed = true
+	}
+	if u.RawQuery != "" {
+		query := u.Query()
+		for key := range query {
+			query[key] = []string{redacted}
+		}
+		u.RawQuery = query.Encode()
+		changed = true
+	}
+	if !changed {
+		return s
+	}
+	return u.String()
+}
+
+// urlPattern finds URLs in log output.
+var urlPattern = regexp.MustCompile(`[a-zA-Z][a-zA-Z0-9+.-]*://[^\s'"]+`)
+
+// redactWriter masks credentials in every URL written through it. It is
+// installed as the log output with -redact, so it also covers URLs that end
+// up in wrapped error messages.
+type redactWriter struct {
+	w io.Writer
+}
+
+func (r redactWriter) Write(p []byte) (int, error) {
+	line := urlPattern.ReplaceAllStringFunc(string(p), redactURL)
+	if _, err := io.WriteString(r.w, line); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// hashLoggedNames makes logName hide file names, set by -redact-paths.
+var hashLoggedNames bool
+
+// logName returns a source file name for logging. With -redact-paths it is
+// replaced by a short hash, so the same file still gets the same token in
+// every line and run.
+func logName(name string) string {
+	if !hashLoggedNames {
+		return name
+	}
+	sum := sha256.Sum256([]byte(name))
+	return "path-" + hex.EncodeToString(sum[:6])
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// checkSourceDevices implements -detect-remount. It compares the device of
+// every source directory with the one recorded by the last successful run,
+// which catches a network mount that dropped and left an empty local
+// directory in its place. A change fails the run unless -force is set. The
+// devices found are returned, to be recorded once the backup succeeded.
+func checkSourceDevices(cfg Config) (map[string]uint64, error) {
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	state, err := loadState(cfg.Target)
+	if err != nil {
+		return nil, err
+	}
+	devices := map[string]uint64{}
+	for _, root := range roots {
+		dev, err := deviceID(root.Path)
+		if err != nil {
+			log.Printf("Warning: -detect-remount: %v", err)
+			continue
+		}
+		devices[root.Path] = dev
+		last, seen := state.SourceDevices[root.Path]
+		if !seen || last == dev {
+			continue
+		}
+		msg := fmt.Sprintf("source '%s' is on a different device than in the last successful run (%d, was %d), a mount may have dropped or changed", root.Path, dev, last)
+		if cfg.Force {
+			log.Printf("Warning: %s, continuing because -force is set", msg)
+			continue
+		}
+		return nil, fmt.Errorf("%s (use -force once to accept the new device)", msg)
+	}
+	return devices, nil
+}
+
+// recordSourceDevices stores the devices found by checkSourceDevices in the
+// state file.
+func recordSourceDevices(cfg Config, devices map[string]uint64) error {
+	state, err := loadState(cfg.Target)
+	if err != nil {
+		return err
+	}
+	if state.SourceDevices == nil {
+		state.SourceDevices = map[string]uint64{}
+	}
+	for path, dev := range devices {
+		state.SourceDevices[path] = dev
+	}
+	return saveState(cfg.Target, state)
+}
+
+// warnEmptySource warns when an archive holds no files at all, which is far
+// more likely a missing mount or a wrong -source than an empty vault.
+func warnEmptySource(cfg Config, arc *archive) {
+	if arc.Files == 0 {
+		log.Printf("Warning: no files found in source '%s', the archive is empty. If the source is a mount, check that it is mounted", cfg.Source)
+	}
+}
@@ -0,0 +1,750 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Restore policies decide what happens when an archive entry already exists
+// in the restore directory.
+const (
+	policySkip      = "skip"      // keep the existing file
+	policyOverwrite = "overwrite" // replace the existing file
+	policyBackup    = "backup"    // rename the existing file to <name>.bak first
+)
+
+// RestoreOptions holds the settings of a restore run.
+type RestoreOptions struct {
+	// Archive is the archive to restore. Setting it switches the tool from
+	// backing up to restoring.
+	Archive string
+	// To is the directory the archive is extracted into.
+	To string
+	// Policy is one of policySkip, policyOverwrite or policyBackup.
+	Policy     string
+	Passphrase string
+	Verbose    bool
+	// Progress periodically logs how far the restore has got.
+	Progress bool
+	// InPlace restores directly into To. Otherwise runRestore restores
+	// into a new timestamped subdirectory of To.
+	InPlace bool
+	// Flatten strips the first component of every entry name, for archives
+	// whose content is wrapped in an extra directory.
+	Flatten bool
+	// Force restores even if the free space check fails.
+	Force bool
+	// Excludes are glob patterns of entries that are not restored, matched
+	// like -exclude. Excluding a directory excludes everything in it.
+	Excludes stringList
+	// ProtectNewer refuses to replace a db.sqlite3 that is newer than the
+	// one in the archive, unless Force is set.
+	ProtectNewer bool
+	// PreserveSparse recreates files stored as sparse entries as sparse
+	// files, skipping over their holes instead of writing zeros.
+	PreserveSparse bool
+	// VerifyManifest compares the entries of the archive with its metadata
+	// sidecar before extracting, and refuses to restore if they differ,
+	// unless Force is set.
+	VerifyManifest bool
+	// Immutable protects the restored files and directories from changes
+	// once the restore is complete, see makeImmutable.
+	Immutable bool
+}
+
+// maxManifestDifferences caps how many differences -verify-manifest logs.
+const maxManifestDifferences = 20
+
+// sparseBlockSize is the granularity at which -restore-preserve-sparse looks
+// for runs of zeros, the block size of common file systems.
+const sparseBlockSize = 4096
+
+// restoreDirName returns the name of the subdirectory a restore started at t
+// goes into unless -restore-in-place is given.
+func restoreDirName(t time.Time) string {
+	return "restore-" + t.Format("2006-01-02T15-04-05")
+}
+
+// RestoreResult is the outcome of a restore, the counterpart of the backup
+// Result. It is logged as the restore summary and written by -report.
+type RestoreResult struct {
+	Success  bool   `json:"success"`
+	ExitCode int    `json:"exit_code"`
+	Error    string `json:"error,omitempty"`
+	Archive  string `json:"archive"`
+	To       string `json:"to"`
+	Policy   string `json:"policy"`
+	// Files and Bytes are the regular files restored and the bytes of
+	// content written for them.
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+	// The action taken for each entry other than a directory: created
+	// anew, overwritten or backed up per Policy, skipped because it exists
+	// or could not be created, or excluded by -restore-exclude.
+	Created     int `json:"created"`
+	Overwritten int `json:"overwritten"`
+	BackedUp    int `json:"backed_up"`
+	Skipped     int `json:"skipped"`
+	Excluded    int `json:"excluded"`
+	// NotRestored lists the FIFOs and device nodes that could not be
+	// created, NotImmutable the paths -restore-immutable could not protect.
+	NotRestored     []string  `json:"not_restored,omitempty"`
+	NotImmutable    []string  `json:"not_immutable,omitempty"`
+	Started         time.Time `json:"started"`
+	Finished        time.Time `json:"finished"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Version         string    `json:"version"`
+	Commit          string    `json:"commit,omitempty"`
+}
+
+// String returns the restore summary that is logged at the end of a restore.
+func (r RestoreResult) String() string {
+	return fmt.Sprintf("%d files (%s) restored in %s: %d created, %d overwritten, %d backed up, %d skipped, %d excluded",
+		r.Files, formatBytes(r.Bytes), time.Duration(r.DurationSeconds*float64(time.Second)).Round(time.Millisecond),
+		r.Created, r.Overwritten, r.BackedUp, r.Skipped, r.Excluded)
+}
+
+// RestoreTarball extracts a zstd-compressed tarball created by
+// CreateDatedZstdTarball into opts.To. Entries that already exist are handled
+// per opts.Policy. Entries that would be written outside opts.To are rejected.
+// It returns the RestoreResult of the run; RestoreResult.Success is false on
+// any error.
+func RestoreTarball(opts RestoreOptions) RestoreResult {
+	v, c := buildInfo()
+	res := RestoreResult{Archive: opts.Archive, To: opts.To, Policy: opts.Policy, Started: time.Now(), Version: v, Commit: c}
+	err := restoreTarball(opts, &res)
+	res.Finished = time.Now()
+	res.DurationSeconds = res.Finished.Sub(res.Started).Seconds()
+	res.ExitCode = exitSuccess
+	res.Success = err == nil
+	if err != nil {
+		res.Error = err.Error()
+		res.ExitCode = exitFailure
+	}
+	return res
+}
+
+// restoreTarball does the work of RestoreTarball, counting what it does in
+// res.
+func restoreTarball(opts RestoreOptions, res *RestoreResult) error {
+	switch opts.Policy {
+	case policySkip, policyOverwrite, policyBackup:
+	default:
+		return fmt.Errorf("unknown restore policy '%s', expected skip, overwrite or backup", opts.Policy)
+	}
+	excludes := stringList{}
+	for _, pattern := range opts.Excludes {
+		pattern = filepath.ToSlash(pattern)
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid -restore-exclude pattern '%s': %w", pattern, err)
+		}
+		excludes = append(excludes, pattern)
+	}
+	opts.Excludes = excludes
+
+	// 1. Open the archive and set up the chain of readers:
+	// file -> decryption (if encrypted) -> zstd -> tar
+	file, err := os.Open(opts.Archive)
+	if err != nil {
+		return fmt.Errorf("failed to open archive '%s': %w", opts.Archive, err)
+	}
+	defer file.Close()
+	tarReader, closeReader, err := newArchiveReader(file, opts.Passphrase)
+	if err != nil {
+		return err
+	}
+	defer closeReader()
+
+	// 2. Check that the restore directory has room for the content, then
+	// ensure it exists
+	if err := checkRestoreSpace(opts); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(opts.To, 0755); err != nil {
+		return fmt.Errorf("failed to create restore directory '%s': %w", opts.To, err)
+	}
+	root, err := filepath.EvalSymlinks(opts.To)
+	if err != nil {
+		return fmt.Errorf("failed to resolve restore directory '%s': %w", opts.To, err)
+	}
+	if opts.VerifyManifest {
+		if err := verifyManifest(opts); err != nil {
+			return err
+		}
+	}
+	if opts.ProtectNewer && opts.Policy != policySkip {
+		if err := checkNewerDatabases(opts, root); err != nil {
+			return err
+		}
+	}
+
+	// 3. Extract each entry, counting the bytes written for -progress. The
+	// total comes from the metadata sidecar if there is one.
+	var prog *progress
+	var content io.Reader = tarReader
+	if opts.Progress {
+		var total int64
+		if meta, err := readMetadata(opts.Archive); err == nil {
+			total = meta.Bytes
+		}
+		prog = startProgress("Restore", total)
+		defer prog.stop()
+		content = io.TeeReader(tarReader, prog.writer(io.Discard))
+	}
+	stripped := map[string]int{}
+	var restoredFiles, restoredDirs []string
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+		if opts.Flatten {
+			name, prefix, ok := flattenName(header.Name)
+			if !ok {
+				if header.Typeflag != tar.TypeDir {
+					log.Printf("Warning: not restoring '%s', it is not inside a directory -restore-flatten can strip", logName(header.Name))
+				}
+				continue
+			}
+			if prefix != "" {
+				stripped[prefix]++
+			}
+			header.Name = name
+			if header.Typeflag == tar.TypeLink {
+				header.Linkname, _, _ = flattenName(header.Linkname)
+			}
+		}
+		if restoreExcluded(opts.Excludes, header.Name) {
+			res.Excluded++
+			if opts.Verbose == true {
+				log.Printf("Excluded from restore: %s", logName(header.Name))
+			}
+			continue
+		}
+		path, err := restorePath(root, header.Name)
+		if err != nil {
+			return err
+		}
+
+		if header.Typeflag == tar.TypeDir {
+			if err := os.MkdirAll(path, header.FileInfo().Mode().Perm()|0700); err != nil {
+				return fmt.Errorf("could not create directory '%s': %w", path, err)
+			}
+			restoredDirs = append(restoredDirs, path)
+			continue
+		}
+		switch header.Typeflag {
+		case tar.TypeReg, tar.TypeGNUSparse, tar.TypeSymlink, tar.TypeLink, tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		default:
+			log.Printf("Skipping unsupported entry '%s' (%s)", logName(header.Name), entryType(header.Typeflag))
+			continue
+		}
+
+		action, err := prepareRestoreTarget(path, opts.Policy)
+		if err != nil {
+			return err
+		}
+		if action == policySkip {
+			res.Skipped++
+			if opts.Verbose == true {
+				log.Printf("Skipped existing: %s", logName(header.Name))
+			}
+			continue
+		}
+		sparse := opts.PreserveSparse && isSparseEntry(header)
+		if err := restoreEntry(root, path, header, content, sparse); err != nil {
+			if !isSpecialEntry(header) {
+				return err
+			}
+			// FIFOs and device nodes are not Vaultwarden data, and creating
+			// a device needs root, so failing to do so does not fail the
+			// restore.
+			log.Printf("Warning: not restoring '%s': %v", logName(header.Name), err)
+			res.Skipped++
+			res.NotRestored = append(res.NotRestored, header.Name)
+			continue
+		}
+		if header.FileInfo().Mode().IsRegular() {
+			res.Files++
+			res.Bytes += header.Size
+			if prog != nil {
+				prog.fileDone()
+			}
+		}
+		if header.Typeflag != tar.TypeSymlink && !isSpecialEntry(header) {
+			restoredFiles = append(restoredFiles, path)
+		}
+		switch action {
+		case policyOverwrite:
+			res.Overwritten++
+		case policyBackup:
+			res.BackedUp++
+		default:
+			res.Created++
+		}
+		if opts.Verbose == true {
+			log.Printf("Restored: %s", logName(header.Name))
+		}
+	}
+	logStripped(stripped)
+
+	// 4. Protect what was restored, now that nothing more is written
+	if opts.Immutable {
+		res.NotImmutable = makeImmutable(restoredFiles, restoredDirs)
+	}
+	return nil
+}
+
+// flattenName implements -restore-flatten: it strips the first component of
+// an entry name and returns the rest and the stripped component. ok is false
+// for a name without a directory to strip, such as the wrapping directory
+// itself. Names that point outside the restore directory are returned as they
+// are, so that restorePath rejects them.
+func flattenName(name string) (rest, prefix string, ok bool) {
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return name, "", true
+	}
+	prefix, rest, found := strings.Cut(clean, "/")
+	if !found {
+		return "", clean, false
+	}
+	return rest, prefix, true
+}
+
+// logStripped reports the leading directories -restore-flatten stripped, with
+// a warning if there were several whose content was merged.
+func logStripped(stripped map[string]int) {
+	prefixes := make([]string, 0, len(stripped))
+	for prefix := range stripped {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		log.Printf("Stripped the leading directory '%s/' from %d entries", logName(prefix), stripped[prefix])
+	}
+	if len(prefixes) > 1 {
+		log.Printf("Warning: -restore-flatten merged the content of %d different leading directories", len(prefixes))
+	}
+}
+
+// restoreSize returns the number of content bytes in the archive. It is
+// taken from the metadata sidecar if there is one, otherwise the headers of
+// the archive are read.
+func restoreSize(opts RestoreOptions) (int64, error) {
+	if meta, err := readMetadata(opts.Archive); err == nil {
+		return meta.Bytes, nil
+	}
+	file, err := os.Open(opts.Archive)
+	if err != nil {
+		return 0, fmt.Errorf("failed to open archive '%s': %w", opts.Archive, err)
+	}
+	defer file.Close()
+	tarReader, closeReader, err := newIndexedArchiveReader(file, opts.Passphrase)
+	if err != nil {
+		return 0, err
+	}
+	defer closeReader()
+	var size int64
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return size, nil
+		}
+		if err != nil {
+			return 0, fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.FileInfo().Mode().IsRegular() {
+			size += header.Size
+		}
+	}
+}
+
+// checkRestoreSpace fails if the file system of the restore directory has
+// less free space than the content of the archive, unless opts.Force is set.
+// The restore directory may not exist yet, so its nearest existing parent is
+// checked.
+func checkRestoreSpace(opts RestoreOptions) error {
+	need, err := restoreSize(opts)
+	if err != nil {
+		return err
+	}
+	dir := opts.To
+	for {
+		if _, err := os.Stat(dir); err == nil || filepath.Dir(dir) == dir {
+			break
+		}
+		dir = filepath.Dir(dir)
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Printf("Warning: could not check free space for the restore: %v", err)
+		return nil
+	}
+	if uint64(need) <= free {
+		return nil
+	}
+	msg := fmt.Sprintf("not enough free space to restore into '%s': need %s, have %s",
+		opts.To, formatBytes(need), formatBytes(int64(free)))
+	if opts.Force {
+		log.Printf("Warning: %s, continuing because -force is set", msg)
+		return nil
+	}
+	return fmt.Errorf("%s (use -force to restore anyway)", msg)
+}
+
+// archiveEntries returns the entries of the archive, from the metadata
+// sidecar if there is one, otherwise from the headers of the archive.
+func archiveEntries(opts RestoreOptions) ([]manifestEntry, error) {
+	if meta, err := readMetadata(opts.Archive); err == nil {
+		return meta.Entries, nil
+	}
+	return headerEntries(opts)
+}
+
+// headerEntries reads the entries from the headers of the archive.
+func headerEntries(opts RestoreOptions) ([]manifestEntry, error) {
+	file, err := os.Open(opts.Archive)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive '%s': %w", opts.Archive, err)
+	}
+	defer file.Close()
+	tarReader, closeReader, err := newIndexedArchiveReader(file, opts.Passphrase)
+	if err != nil {
+		return nil, err
+	}
+	defer closeReader()
+	var entries []manifestEntry
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+		entries = append(entries, newManifestEntry(header))
+	}
+}
+
+// verifyManifest implements -verify-manifest: the name, type and size of
+// every entry in the archive, and the name and size of the archive itself, are
+// compared with its metadata sidecar. A difference means the archive or the
+// sidecar was corrupted or swapped for another one, so the restore is refused
+// unless opts.Force is set. An archive without a sidecar is restored with a
+// warning.
+func verifyManifest(opts RestoreOptions) error {
+	meta, err := readMetadata(opts.Archive)
+	if errors.Is(err, os.ErrNotExist) {
+		log.Printf("Warning: '%s' has no metadata sidecar, its entries cannot be verified", opts.Archive)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	entries, err := headerEntries(opts)
+	if err != nil {
+		return err
+	}
+
+	var diffs []string
+	if name := filepath.Base(opts.Archive); meta.Archive != name {
+		diffs = append(diffs, fmt.Sprintf("the metadata describes '%s', not '%s'", meta.Archive, name))
+	}
+	if info, err := os.Stat(opts.Archive); err == nil && info.Size() != meta.Size {
+		diffs = append(diffs, fmt.Sprintf("the archive is %d bytes, the metadata says %d", info.Size(), meta.Size))
+	}
+	want := make(map[string]manifestEntry, len(meta.Entries))
+	for _, e := range meta.Entries {
+		want[e.Name] = e
+	}
+	for _, got := range entries {
+		e, ok := want[got.Name]
+		switch {
+		case !ok:
+			diffs = append(diffs, fmt.Sprintf("'%s' is in the archive but not in the metadata", logName(got.Name)))
+		case e.Type != got.Type:
+			diffs = append(diffs, fmt.Sprintf("'%s' is a %s in the archive but a %s in the metadata", logName(got.Name), got.Type, e.Type))
+		case e.Size != got.Size:
+			diffs = append(diffs, fmt.Sprintf("'%s' is %d bytes in the archive but %d in the metadata", logName(got.Name), got.Size, e.Size))
+		}
+		delete(want, got.Name)
+	}
+	for _, e := range meta.Entries {
+		if _, ok := want[e.Name]; ok {
+			diffs = append(diffs, fmt.Sprintf("'%s' is in the metadata but not in the archive", logName(e.Name)))
+		}
+	}
+	if len(diffs) == 0 {
+		log.Printf("Manifest check passed: all %d entries match the metadata sidecar", len(entries))
+		return nil
+	}
+
+	for i, diff := range diffs {
+		if i == maxManifestDifferences {
+			log.Printf("... and %d more differences", len(diffs)-i)
+			break
+		}
+		log.Printf("Manifest mismatch: %s", diff)
+	}
+	msg := fmt.Sprintf("archive '%s' does not match its metadata sidecar, %d differences", opts.Archive, len(diffs))
+	if opts.Force {
+		log.Printf("Warning: %s, restoring anyway because -force is set", msg)
+		return nil
+	}
+	return fmt.Errorf("%s, it may be corrupted or swapped with another file (use -force to restore anyway)", msg)
+}
+
+// checkNewerDatabases implements -restore-protect-newer. Before anything is
+// written, every db.sqlite3 in the archive is compared with the file it would
+// replace, and the restore is refused if the existing file was modified
+// later, since that would roll the vault back over recent changes. Archives
+// made with -preserve-timestamps=false carry no modification times, so their
+// databases cannot be compared and only a warning is logged.
+func checkNewerDatabases(opts RestoreOptions, root string) error {
+	entries, err := archiveEntries(opts)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if opts.Flatten {
+			name, _, ok := flattenName(entry.Name)
+			if !ok {
+				continue
+			}
+			entry.Name = name
+		}
+		if entry.Type != "file" || path.Base(entry.Name) != "db.sqlite3" || restoreExcluded(opts.Excludes, entry.Name) {
+			continue
+		}
+		target, err := restorePath(root, entry.Name)
+		if err != nil {
+			return err
+		}
+		info, err := os.Stat(target)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("could not stat '%s': %w", target, err)
+		}
+		if entry.ModTime.Equal(reproducibleModTime) {
+			log.Printf("Warning: cannot tell whether '%s' is newer than the archive, which was made without timestamps", target)
+			continue
+		}
+		if !info.ModTime().After(entry.ModTime) {
+			continue
+		}
+		msg := fmt.Sprintf("existing '%s' (modified %s, %s) is newer than the copy in the archive (modified %s, %s)",
+			target, info.ModTime().Format(time.RFC3339), formatBytes(info.Size()),
+			entry.ModTime.Format(time.RFC3339), formatBytes(entry.Size))
+		if opts.Force {
+			log.Printf("Warning: %s, replacing it because -force is set", msg)
+			continue
+		}
+		return fmt.Errorf("%s, restoring would discard the newer changes (use -force to restore anyway)", msg)
+	}
+	return nil
+}
+
+// restoreExcluded reports whether the entry name, or a directory it is in,
+// matches one of the -restore-exclude patterns.
+func restoreExcluded(patterns []string, name string) bool {
+	for p := strings.TrimSuffix(name, "/"); p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		if matchesAny(patterns, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// restorePath maps a tar entry name to a path inside root, with the slashes
+// of the name turned into the separator of the system. It rejects names that
+// are absolute or climb out of root, on Windows also reserved names such as
+// NUL and names with a colon, and names whose parent directory resolves
+// outside root through a symlink restored earlier.
+func restorePath(root, name string) (string, error) {
+	clean := filepath.Clean(filepath.FromSlash(name))
+	if !filepath.IsLocal(clean) {
+		return "", fmt.Errorf("archive entry '%s' points outside the restore directory", name)
+	}
+	path := filepath.Join(root, clean)
+
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return path, nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("could not resolve parent of '%s': %w", path, err)
+	}
+	if rel, err := filepath.Rel(root, parent); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("archive entry '%s' resolves outside the restore directory", name)
+	}
+	return path, nil
+}
+
+// prepareRestoreTarget applies the restore policy to an existing path. It
+// returns the action taken: "" if nothing exists yet, or the policy itself.
+func prepareRestoreTarget(path, policy string) (string, error) {
+	if _, err := os.Lstat(path); errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("could not stat '%s': %w", path, err)
+	}
+	switch policy {
+	case policyBackup:
+		if err := os.Rename(path, path+".bak"); err != nil {
+			return "", fmt.Errorf("could not back up existing '%s': %w", path, err)
+		}
+	case policyOverwrite:
+		if err := os.Remove(path); err != nil {
+			return "", fmt.Errorf("could not remove existing '%s': %w", path, err)
+		}
+	}
+	return policy, nil
+}
+
+// isSparseEntry reports whether a file was stored with one of the GNU sparse
+// extensions, in the old GNU format or in PAX records. The tar reader fills in
+// the holes with zeros either way.
+func isSparseEntry(header *tar.Header) bool {
+	if header.Typeflag == tar.TypeGNUSparse {
+		return true
+	}
+	for key := range header.PAXRecords {
+		if strings.HasPrefix(key, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// writeSparse copies size bytes from r to file, seeking over each block of
+// zeros instead of writing it so the file system leaves a hole there.
+func writeSparse(file *os.File, r io.Reader, size int64) error {
+	buf := make([]byte, sparseBlockSize)
+	zeros := make([]byte, sparseBlockSize)
+	for written := int64(0); written < size; {
+		n, err := io.ReadFull(r, buf[:min(int64(len(buf)), size-written)])
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(buf[:n], zeros[:n]) {
+			if _, err := file.Seek(int64(n), io.SeekCurrent); err != nil {
+				return err
+			}
+		} else if _, err := file.Write(buf[:n]); err != nil {
+			return err
+		}
+		written += int64(n)
+	}
+	// A trailing hole is only part of the file once its size is set.
+	return file.Truncate(size)
+}
+
+// isSpecialEntry reports whether header is a FIFO or device node entry.
+func isSpecialEntry(header *tar.Header) bool {
+	switch header.Typeflag {
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		return true
+	}
+	return false
+}
+
+// restoreEntry writes a single file, symlink, hard link, FIFO or device node
+// entry to path. With sparse set, runs of zeros in a file are left as holes.
+func restoreEntry(root, path string, header *tar.Header, r io.Reader, sparse bool) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("could not create directory for '%s': %w", path, err)
+	}
+	switch header.Typeflag {
+	case tar.TypeSymlink:
+		if err := os.Symlink(filepath.FromSlash(header.Linkname), path); err != nil {
+			return fmt.Errorf("could not create symlink '%s': %w", path, err)
+		}
+		return nil
+	case tar.TypeLink:
+		target, err := restorePath(root, header.Linkname)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return fmt.Errorf("could not create hard link '%s': %w", path, err)
+		}
+		return nil
+	case tar.TypeFifo, tar.TypeChar, tar.TypeBlock:
+		if err := makeSpecial(path, header); err != nil {
+			return fmt.Errorf("could not create %s '%s': %w", entryType(header.Typeflag), path, err)
+		}
+		return nil
+	}
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, header.FileInfo().Mode().Perm())
+	if err != nil {
+		return fmt.Errorf("could not create file '%s': %w", path, err)
+	}
+	if sparse {
+		err = writeSparse(file, r, header.Size)
+	} else {
+		_, err = io.Copy(file, r)
+	}
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("could not write file '%s': %w", path, err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not close file '%s': %w", path, err)
+	}
+	if err := os.Chtimes(path, time.Time{}, header.ModTime); err != nil {
+		return fmt.Errorf("could not set modification time of '%s': %w", path, err)
+	}
+	return nil
+}
+
+// runRestore runs a restore from the command line settings and returns the
+// process exit code.
+func runRestore(cfg Config) int {
+	opts := cfg.Restore
+	opts.Verbose = cfg.Verbose
+	opts.Progress = cfg.Progress
+	opts.Passphrase = cfg.Passphrase
+	opts.Force = cfg.Force
+	if !opts.InPlace {
+		opts.To = filepath.Join(opts.To, restoreDirName(time.Now()))
+	}
+	log.Printf("--- Starting Restore of %s into %s ---", opts.Archive, opts.To)
+	res := RestoreTarball(opts)
+	log.Printf("Restore summary: %s", res)
+	writeRestoreReport(cfg, res)
+	if !res.Success {
+		log.Printf("Error restoring tarball: %s", res.Error)
+		log.Println("--- Restore failed. ---")
+		return res.ExitCode
+	}
+	log.Printf("Restored files are in %s", opts.To)
+	log.Println("--- Restore completed successfully! ---")
+	return exitSuccess
+}
+
+// writeRestoreReport writes the result of a restore to -report, if set.
+func writeRestoreReport(cfg Config, res RestoreResult) {
+	if cfg.ReportPath == "" {
+		return
+	}
+	if err := writeReport(cfg.ReportPath, res); err != nil {
+		log.Printf("Error writing report: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRestorePath(t *testing.T) {
+	// restoreTarball resolves the restore directory before calling
+	// restorePath, so the test does too.
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Creating symlinks can need extra privileges on Windows.
+	canLink := os.Symlink(t.TempDir(), filepath.Join(root, "outside")) == nil
+	tests := []struct {
+		name string
+		want string // slash separated and relative to root, "" if the name must be rejected
+	}{
+		{"db.sqlite3", "db.sqlite3"},
+		{"attachments/1/file.bin", "attachments/1/file.bin"},
+		{"./attachments//1/", "attachments/1"},
+		{"attachments/../db.sqlite3", "db.sqlite3"},
+		{"..", ""},
+		{"../db.sqlite3", ""},
+		{"attachments/../../db.sqlite3", ""},
+		{"/etc/passwd", ""},
+		{"outside/db.sqlite3", ""},
+	}
+	for _, tt := range tests {
+		if tt.name == "outside/db.sqlite3" && !canLink {
+			continue
+		}
+		got, err := restorePath(root, tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("restorePath(%q) = %q, want it rejected", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("restorePath(%q) failed: %v", tt.name, err)
+		} else if want := filepath.Join(root, filepath.FromSlash(tt.want)); got != want {
+			t.Errorf("restorePath(%q) = %q, want %q", tt.name, got, want)
+		}
+	}
+}
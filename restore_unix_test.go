@@ -0,0 +1,170 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// sparseTestSize is the size of the sparse file in TestRestorePreserveSparse,
+// one block of data at its start and one in the middle of an otherwise empty
+// MiB.
+const sparseTestSize = 1 << 20
+
+var sparseTestBlocks = map[int64]byte{0: 'a', sparseTestSize / 2: 'b'}
+
+// writeSparseSource creates the sparse test file at path and returns its
+// content.
+func writeSparseSource(t *testing.T, path string) []byte {
+	t.Helper()
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := file.Truncate(sparseTestSize); err != nil {
+		t.Fatal(err)
+	}
+	content := make([]byte, sparseTestSize)
+	for offset, b := range sparseTestBlocks {
+		block := bytes.Repeat([]byte{b}, sparseBlockSize)
+		if _, err := file.WriteAt(block, offset); err != nil {
+			t.Fatal(err)
+		}
+		copy(content[offset:], block)
+	}
+	return content
+}
+
+// paxRecord formats a PAX extended header record, whose length prefix counts
+// itself.
+func paxRecord(key, value string) string {
+	record := " " + key + "=" + value + "\n"
+	size := len(record)
+	for size < len(strconv.Itoa(size))+len(record) {
+		size++
+	}
+	return strconv.Itoa(size) + record
+}
+
+// writeSparseArchive writes an archive holding the sparse test file as name,
+// stored as a PAX sparse entry in GNU format 0.1. archive/tar reads such
+// entries but drops GNU.sparse records when writing, so the PAX header is
+// written as a ustar file entry whose type is then changed to 'x'.
+func writeSparseArchive(t *testing.T, path, name string) {
+	t.Helper()
+	var stored []byte
+	var sparseMap string
+	for _, offset := range []int64{0, sparseTestSize / 2} {
+		stored = append(stored, bytes.Repeat([]byte{sparseTestBlocks[offset]}, sparseBlockSize)...)
+		if sparseMap != "" {
+			sparseMap += ","
+		}
+		sparseMap += strconv.FormatInt(offset, 10) + "," + strconv.Itoa(sparseBlockSize)
+	}
+	records := paxRecord("GNU.sparse.size", strconv.Itoa(sparseTestSize)) +
+		paxRecord("GNU.sparse.numblocks", strconv.Itoa(len(sparseTestBlocks))) +
+		paxRecord("GNU.sparse.map", sparseMap) +
+		paxRecord("GNU.sparse.name", name)
+
+	var buf bytes.Buffer
+	tarWriter := tar.NewWriter(&buf)
+	entries := []struct {
+		header  *tar.Header
+		content []byte
+	}{
+		{&tar.Header{Name: "PaxHeaders/" + name, Mode: 0644, Size: int64(len(records))}, []byte(records)},
+		{&tar.Header{Name: "GNUSparseFile.0/" + name, Mode: 0644, Size: int64(len(stored))}, stored},
+	}
+	for _, entry := range entries {
+		entry.header.Format = tar.FormatUSTAR
+		if err := tarWriter.WriteHeader(entry.header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tarWriter.Write(entry.content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tarWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// The type flag is byte 156 of the first header block, the checksum
+	// the octal sum of the block with the checksum field read as spaces.
+	block := buf.Bytes()[:512]
+	block[156] = tar.TypeXHeader
+	copy(block[148:156], "        ")
+	sum := 0
+	for _, b := range block {
+		sum += int(b)
+	}
+	copy(block[148:156], fmt.Sprintf("%06o\x00 ", sum))
+
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	zstdWriter, err := zstd.NewWriter(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zstdWriter.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := zstdWriter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRestorePreserveSparse(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "data")
+	if err := os.Mkdir(source, 0755); err != nil {
+		t.Fatal(err)
+	}
+	want := writeSparseSource(t, filepath.Join(source, "db.sqlite3"))
+
+	// Archives written by a backup hold sparse files as regular entries,
+	// so they come back complete but not sparse.
+	arc, err := createTarball(testConfig(source, filepath.Join(dir, "backups")), sourceSize{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sparseArchive := filepath.Join(dir, "sparse.tar.zstd")
+	writeSparseArchive(t, sparseArchive, "db.sqlite3")
+
+	for _, archive := range []string{arc.Path, sparseArchive} {
+		to := filepath.Join(dir, "restore", filepath.Base(archive))
+		res := RestoreTarball(RestoreOptions{Archive: archive, To: to, Policy: policySkip, PreserveSparse: true})
+		if !res.Success {
+			t.Fatalf("restoring %s failed: %s", filepath.Base(archive), res.Error)
+		}
+		path := filepath.Join(to, "db.sqlite3")
+		got, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("content restored from %s differs from the sparse source file", filepath.Base(archive))
+		}
+		if archive != sparseArchive {
+			continue
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if allocated := info.Sys().(*syscall.Stat_t).Blocks * 512; allocated >= info.Size() {
+			t.Errorf("restored file has %d bytes allocated for a size of %d, want it to be sparse", allocated, info.Size())
+		}
+	}
+}
@@ -0,0 +1,56 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestWindowsRestorePath(t *testing.T) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		want string // relative to root, "" if the name must be rejected
+	}{
+		{"db.sqlite3", "db.sqlite3"},
+		{"attachments/1/file.bin", `attachments\1\file.bin`},
+		{`attachments\1\file.bin`, `attachments\1\file.bin`},
+		{`attachments/1\file.bin`, `attachments\1\file.bin`},
+		{"attachments/../db.sqlite3", "db.sqlite3"},
+		{`attachments\..\db.sqlite3`, "db.sqlite3"},
+		{"../db.sqlite3", ""},
+		{`..\db.sqlite3`, ""},
+		{`attachments\..\..\db.sqlite3`, ""},
+		{`attachments/..\../db.sqlite3`, ""},
+		{`C:\Windows\System32\evil.dll`, ""},
+		{"C:/Windows/evil.dll", ""},
+		{`C:evil.dll`, ""},
+		{`\Windows\evil.dll`, ""},
+		{"/Windows/evil.dll", ""},
+		{`\\server\share\evil.dll`, ""},
+		{"//server/share/evil.dll", ""},
+		{`\\?\C:\evil.dll`, ""},
+		{"db.sqlite3:stream", ""},
+		{"NUL", ""},
+		{"attachments/nul", ""},
+		{"COM1", ""},
+	}
+	for _, tt := range tests {
+		got, err := restorePath(root, tt.name)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("restorePath(%q) = %q, want it rejected", tt.name, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("restorePath(%q) failed: %v", tt.name, err)
+		} else if want := filepath.Join(root, tt.want); got != want {
+			t.Errorf("restorePath(%q) = %q, want %q", tt.name, got, want)
+		}
+	}
+}
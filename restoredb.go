@@ -0,0 +1,68 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+)
+
+// vaultwardenDBName is the file name of Vaultwarden's SQLite database.
+const vaultwardenDBName = "db.sqlite3"
+
+// extractDatabase copies the Vaultwarden database out of an archive stream
+// into out. The database is found by file name, so it is also found in
+// archives of several sources where it sits under a directory prefix; if more
+// than one matches, the first one is used.
+func extractDatabase(r io.Reader, passphrase, out string) (string, error) {
+	if _, err := os.Lstat(out); err == nil {
+		return "", fmt.Errorf("output file '%s' already exists, remove it first", out)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("could not stat output file '%s': %w", out, err)
+	}
+	tarReader, closeReader, err := newIndexedArchiveReader(r, passphrase)
+	if err != nil {
+		return "", err
+	}
+	defer closeReader()
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return "", fmt.Errorf("no %s found in the archive", vaultwardenDBName)
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to read archive: %w", err)
+		}
+		if header.Typeflag != tar.TypeReg || path.Base(header.Name) != vaultwardenDBName {
+			continue
+		}
+		if err := writeStreamAtomic(out, tarReader, 0600); err != nil {
+			return "", err
+		}
+		return header.Name, nil
+	}
+}
+
+// runRestoreDB extracts the database from the archive given with -restore-db
+// and returns the process exit code.
+func runRestoreDB(cfg Config) int {
+	ctx := context.Background()
+	stream, err := openArchiveStream(ctx, cfg, cfg.RestoreDB)
+	if err != nil {
+		log.Printf("Error restoring database: %v", err)
+		return exitFailure
+	}
+	defer stream.Close()
+	name, err := extractDatabase(stream, cfg.Passphrase, cfg.RestoreDBOut)
+	if err != nil {
+		log.Printf("Error restoring database: %v", err)
+		return exitFailure
+	}
+	log.Printf("Restored '%s' from %s to %s", name, cfg.RestoreDB, cfg.RestoreDBOut)
+	return exitSuccess
+}
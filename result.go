@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Exit codes of the process. exitUploadFailure means the local archive was
+// created successfully but copying it to a remote destination failed.
+const (
+	exitSuccess       = 0
+	exitFailure       = 1
+	exitUploadFailure = 2
+)
+
+// Result describes the outcome of a backup run. It is what gets written by
+// -report and is the basis of notifications.
+type Result struct {
+	Success         bool           `json:"success"`
+	ExitCode        int            `json:"exit_code"`
+	Error           string         `json:"error,omitempty"`
+	Skipped         string         `json:"skipped,omitempty"`
+	Source          string         `json:"source"`
+	Target          string         `json:"target"`
+	Archive         string         `json:"archive,omitempty"`
+	Label           string         `json:"label,omitempty"`
+	Hash            string         `json:"hash,omitempty"`
+	SHA256          string         `json:"sha256,omitempty"`
+	Files           int            `json:"files"`
+	Bytes           int64          `json:"bytes"`
+	ArchiveBytes    int64          `json:"archive_bytes"`
+	Started         time.Time      `json:"started"`
+	Finished        time.Time      `json:"finished"`
+	DurationSeconds float64        `json:"duration_seconds"`
+	Incomplete      []string       `json:"incomplete,omitempty"`
+	IgnoredErrors   []string       `json:"ignored_errors,omitempty"`
+	Changed         []string       `json:"changed_during_backup,omitempty"`
+	Uploads         []UploadResult `json:"uploads,omitempty"`
+	Pruned          []string       `json:"pruned,omitempty"`
+	Version         string         `json:"version"`
+	Commit          string         `json:"commit,omitempty"`
+}
+
+// newResult starts a Result for a run that begins now.
+func newResult(cfg Config) Result {
+	v, c := buildInfo()
+	return Result{
+		Source:  cfg.Source,
+		Target:  cfg.Target,
+		Started: time.Now(),
+		Version: v,
+		Commit:  c,
+	}
+}
+
+// finish records the archive (which may be nil) and error of the run.
+func (r *Result) finish(arc *archive, err error) {
+	r.Finished = time.Now()
+	r.DurationSeconds = r.Finished.Sub(r.Started).Seconds()
+	if arc != nil {
+		r.Archive = arc.Path
+		r.Label = arc.Fields.Label
+		r.Hash = arc.Hash
+		r.SHA256 = arc.SHA256
+		r.Files = arc.Files
+		r.Bytes = arc.Bytes
+		r.ArchiveBytes = arc.Size
+		r.Incomplete = arc.Incomplete
+		r.IgnoredErrors = arc.IgnoredErrors
+		r.Changed = arc.Changed
+	}
+	switch {
+	case err == nil:
+		r.Success = true
+		r.ExitCode = exitSuccess
+	case errors.Is(err, errUploadFailed):
+		r.Error = err.Error()
+		r.ExitCode = exitUploadFailure
+	default:
+		r.Error = err.Error()
+		r.ExitCode = exitFailure
+	}
+}
+
+// writeReport writes the result of a backup or restore as indented JSON to
+// path.
+func writeReport(path string, r any) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode report: %w", err)
+	}
+	return writeFileAtomic(path, append(data, '\n'), 0644)
+}
+
+// writeResultJSON writes the result to -result-json, if set.
+func writeResultJSON(cfg Config, r Result) {
+	if cfg.ResultJSON == "" {
+		return
+	}
+	if err := writeReport(cfg.ResultJSON, r); err != nil {
+		log.Printf("Error writing result JSON: %v", err)
+	}
+}
+
+// failResult writes a -result-json for a run that failed with err before a
+// backup was attempted.
+func failResult(cfg Config, err error) {
+	res := newResult(cfg)
+	res.finish(nil, err)
+	writeResultJSON(cfg, res)
+}
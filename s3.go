@@ -0,0 +1,270 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/s3/manager"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+	"github.com/aws/smithy-go"
+)
+
+// s3ChecksumAlgorithms are the values of -s3-checksum.
+var s3ChecksumAlgorithms = map[string]types.ChecksumAlgorithm{
+	"crc32":  types.ChecksumAlgorithmCrc32,
+	"crc32c": types.ChecksumAlgorithmCrc32c,
+	"sha1":   types.ChecksumAlgorithmSha1,
+	"sha256": types.ChecksumAlgorithmSha256,
+}
+
+// s3ChecksumErrorCodes are the S3 error codes of a request whose checksum did
+// not match the data the server received.
+var s3ChecksumErrorCodes = map[string]bool{
+	"BadDigest":                   true,
+	"InvalidDigest":               true,
+	"XAmzContentChecksumMismatch": true,
+	"XAmzContentSHA256Mismatch":   true,
+}
+
+// errChecksumMismatch marks an upload that S3 rejected because the checksum
+// of a part did not match what it received.
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// checkS3Checksum validates -s3-checksum.
+func checkS3Checksum(name string) error {
+	if _, ok := s3ChecksumAlgorithms[name]; name != "" && !ok {
+		return fmt.Errorf("unknown -s3-checksum '%s', expected sha256, sha1, crc32 or crc32c", name)
+	}
+	return nil
+}
+
+// s3Destination uploads archives to an S3 (or S3 compatible) bucket.
+// Credentials are resolved by the AWS SDK's default chain, e.g. the
+// AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY environment variables.
+type s3Destination struct {
+	bucket   string
+	prefix   string
+	client   *s3.Client
+	uploader *manager.Uploader
+	// checksum is the algorithm of the per-part checksums sent with every
+	// upload, empty for the SDK default.
+	checksum types.ChecksumAlgorithm
+}
+
+// newS3Destination creates a destination for the given bucket. Every key
+// stored through it is placed under prefix.
+func newS3Destination(ctx context.Context, cfg Config, bucket, prefix string) (*s3Destination, error) {
+	var opts []func(*config.LoadOptions) error
+	if cfg.S3Region != "" {
+		opts = append(opts, config.WithRegion(cfg.S3Region))
+	}
+	awsCfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+	client := s3.NewFromConfig(awsCfg, func(o *s3.Options) {
+		if cfg.S3Endpoint != "" {
+			o.BaseEndpoint = aws.String(cfg.S3Endpoint)
+		}
+		o.UsePathStyle = cfg.S3PathStyle
+	})
+
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Destination{
+		bucket:   bucket,
+		prefix:   prefix,
+		client:   client,
+		checksum: s3ChecksumAlgorithms[cfg.S3Checksum],
+		uploader: manager.NewUploader(client, func(u *manager.Uploader) {
+			if lowMemoryCodecs {
+				u.Concurrency = 1
+			}
+		}),
+	}, nil
+}
+
+func (d *s3Destination) Name() string {
+	return "s3://" + d.bucket + "/" + d.prefix
+}
+
+func (d *s3Destination) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	out, err := d.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download s3://%s/%s: %w", d.bucket, d.prefix+key, err)
+	}
+	return out.Body, nil
+}
+
+// OpenRanged opens the object at key for random access, see s3Object.
+func (d *s3Destination) OpenRanged(ctx context.Context, key string) (*s3Object, error) {
+	out, err := d.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect s3://%s/%s: %w", d.bucket, d.prefix+key, err)
+	}
+	return &s3Object{ctx: ctx, dest: d, key: d.prefix + key, size: aws.ToInt64(out.ContentLength)}, nil
+}
+
+// s3Object reads an S3 object through ranged GET requests. Read streams from
+// the current offset in a single request, which is only replaced when a Seek
+// moves away from it, and ReadAt fetches exactly the range it is asked for.
+// That lets openSeekable fetch just the frames of a seekable archive that
+// hold the entries it needs, while other archives are streamed.
+type s3Object struct {
+	ctx  context.Context
+	dest *s3Destination
+	key  string
+	size int64
+	off  int64         // offset of the next Read
+	body io.ReadCloser // open stream at off, nil until the next Read
+}
+
+// get requests the bytes of the object from first to last inclusive, or to
+// its end if last is negative.
+func (o *s3Object) get(first, last int64) (io.ReadCloser, error) {
+	byteRange := fmt.Sprintf("bytes=%d-", first)
+	if last >= 0 {
+		byteRange += strconv.FormatInt(last, 10)
+	}
+	out, err := o.dest.client.GetObject(o.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(o.dest.bucket),
+		Key:    aws.String(o.key),
+		Range:  aws.String(byteRange),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s of s3://%s/%s: %w", byteRange, o.dest.bucket, o.key, err)
+	}
+	return out.Body, nil
+}
+
+func (o *s3Object) Read(p []byte) (int, error) {
+	if o.off >= o.size {
+		return 0, io.EOF
+	}
+	if o.body == nil {
+		body, err := o.get(o.off, -1)
+		if err != nil {
+			return 0, err
+		}
+		o.body = body
+	}
+	n, err := o.body.Read(p)
+	o.off += int64(n)
+	return n, err
+}
+
+func (o *s3Object) ReadAt(p []byte, off int64) (int, error) {
+	if off >= o.size {
+		return 0, io.EOF
+	}
+	end := min(off+int64(len(p)), o.size)
+	body, err := o.get(off, end-1)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+	n, err := io.ReadFull(body, p[:end-off])
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (o *s3Object) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += o.off
+	case io.SeekEnd:
+		offset += o.size
+	default:
+		return 0, fmt.Errorf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, fmt.Errorf("cannot seek to negative offset %d", offset)
+	}
+	if offset != o.off {
+		o.Close()
+		o.off = offset
+	}
+	return offset, nil
+}
+
+func (o *s3Object) Close() error {
+	if o.body == nil {
+		return nil
+	}
+	err := o.body.Close()
+	o.body = nil
+	return err
+}
+
+// RemoteMD5 returns the object's ETag when it is the MD5 of its content. That
+// is the case for single part uploads without SSE-KMS or SSE-C encryption;
+// multipart ETags end in "-<parts>" and are not content hashes.
+func (d *s3Destination) RemoteMD5(ctx context.Context, key string) (string, bool, error) {
+	out, err := d.client.HeadObject(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(d.bucket),
+		Key:    aws.String(d.prefix + key),
+	})
+	if err != nil {
+		return "", false, fmt.Errorf("failed to inspect s3://%s/%s: %w", d.bucket, d.prefix+key, err)
+	}
+	etag := strings.Trim(aws.ToString(out.ETag), `"`)
+	if len(etag) != 32 || strings.Contains(etag, "-") ||
+		out.ServerSideEncryption == types.ServerSideEncryptionAwsKms ||
+		out.ServerSideEncryption == types.ServerSideEncryptionAwsKmsDsse ||
+		out.SSECustomerAlgorithm != nil {
+		return "", false, nil
+	}
+	return etag, true, nil
+}
+
+// Store uploads r under key. The size is sent as the length of a single part
+// upload and, since the uploader cannot measure the pipes of
+// storeFileFanOut, used to grow the parts of a multipart upload so that it
+// stays within manager.MaxUploadParts.
+func (d *s3Destination) Store(ctx context.Context, key string, r io.Reader, size int64) error {
+	input := &s3.PutObjectInput{
+		Bucket:            aws.String(d.bucket),
+		Key:               aws.String(d.prefix + key),
+		Body:              r,
+		ChecksumAlgorithm: d.checksum,
+	}
+	var options []func(*manager.Uploader)
+	if size >= 0 {
+		input.ContentLength = aws.Int64(size)
+		options = append(options, func(u *manager.Uploader) {
+			u.PartSize = max(u.PartSize, size/int64(u.MaxUploadParts)+1)
+		})
+	}
+	_, err := d.uploader.Upload(ctx, input, options...)
+	var apiErr smithy.APIError
+	if errors.As(err, &apiErr) && s3ChecksumErrorCodes[apiErr.ErrorCode()] {
+		checksum := strings.ToLower(string(d.checksum))
+		if checksum == "" {
+			checksum = "crc32 (the SDK default)"
+		}
+		return fmt.Errorf("failed to upload to s3://%s/%s: %w: S3 received data that does not match its %s checksum, it was corrupted in transit: %v",
+			d.bucket, d.prefix+key, errChecksumMismatch, checksum, err)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to upload to s3://%s/%s: %w", d.bucket, d.prefix+key, err)
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeS3 serves objects for HEAD and, with or without a Range header, GET
+// requests in path style, counting the bytes it sends.
+type fakeS3 struct {
+	mu      sync.Mutex
+	objects map[string][]byte // keyed by /bucket/key
+	sent    int64
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.objects[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	first, last := int64(0), int64(len(data)-1)
+	status := http.StatusOK
+	if spec, ok := strings.CutPrefix(r.Header.Get("Range"), "bytes="); ok {
+		from, to, _ := strings.Cut(spec, "-")
+		first, _ = strconv.ParseInt(from, 10, 64)
+		if to != "" {
+			last, _ = strconv.ParseInt(to, 10, 64)
+		}
+		last = min(last, int64(len(data)-1))
+		status = http.StatusPartialContent
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		n, _ := w.Write(data[first : last+1])
+		f.sent += int64(n)
+	}
+}
+
+// bytesSent returns the number of bytes sent so far.
+func (f *fakeS3) bytesSent() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.sent
+}
+
+func TestListS3Archive(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "test")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "test")
+	t.Setenv("AWS_CONFIG_FILE", filepath.Join(t.TempDir(), "config"))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"db.sqlite3": "database"})
+	// Incompressible content sorted before the database fills several
+	// frames that reading the database can skip.
+	big := make([]byte, 8*seekableFrameSize)
+	rand.Read(big)
+	if err := os.MkdirAll(filepath.Join(source, "attachments"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(source, "attachments", "big.bin"), big, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, seekable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("seekable=%v", seekable), func(t *testing.T) {
+			cfg := testConfig(source, t.TempDir())
+			cfg.Seekable = seekable
+			arc, err := createTarball(cfg, sourceSize{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := os.ReadFile(arc.Path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s3 := &fakeS3{objects: map[string][]byte{"/bucket/backups/" + filepath.Base(arc.Path): data}}
+			server := httptest.NewServer(s3)
+			defer server.Close()
+			cfg.S3Endpoint, cfg.S3PathStyle, cfg.S3Region = server.URL, true, "us-east-1"
+			spec := "s3://bucket/backups/" + filepath.Base(arc.Path)
+
+			stream, err := openArchiveStream(context.Background(), cfg, spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var out bytes.Buffer
+			count, err := listArchive(stream, "", &out)
+			stream.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			sent := s3.bytesSent()
+			if count != 3 || !strings.Contains(out.String(), "attachments/big.bin") || !strings.Contains(out.String(), "db.sqlite3") {
+				t.Errorf("listed %d entries:\n%s", count, out.String())
+			}
+			if seekable && sent >= int64(len(data))/2 {
+				t.Errorf("listing a seekable archive of %d bytes downloaded %d of them", len(data), sent)
+			}
+			// openSeekable only reads the footer of a streamed archive
+			// before it is downloaded once.
+			if !seekable && sent > int64(len(data))+1024 {
+				t.Errorf("listing a streamed archive of %d bytes downloaded %d bytes", len(data), sent)
+			}
+		})
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// inventory is the JSON document written by -scan. Entries use the same
+// format as the metadata sidecar, so the two can be compared directly.
+type inventory struct {
+	Source  string          `json:"source"`
+	Scanned time.Time       `json:"scanned"`
+	Files   int             `json:"files"`
+	Dirs    int             `json:"dirs"`
+	Bytes   int64           `json:"bytes"`
+	Entries []manifestEntry `json:"entries"`
+}
+
+// scanSource lists everything a backup with the current settings would
+// archive, without reading any file content.
+func scanSource(cfg Config) (inventory, error) {
+	inv := inventory{Source: cfg.Source, Scanned: time.Now(), Entries: []manifestEntry{}}
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return inv, err
+	}
+	filter, err := newSourceFilter(cfg)
+	if err != nil {
+		return inv, err
+	}
+	err = walkSource(roots, filter, nil, func(path, name string, info os.FileInfo) error {
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = readLink(path); err != nil {
+				return fmt.Errorf("could not read symlink '%s': %w", path, err)
+			}
+		}
+		header, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return fmt.Errorf("could not create tar header for '%s': %w", path, err)
+		}
+		header.Name = name
+		inv.Entries = append(inv.Entries, newManifestEntry(header))
+		switch {
+		case info.IsDir():
+			inv.Dirs++
+		case info.Mode().IsRegular():
+			inv.Files++
+			inv.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return inv, fmt.Errorf("failed to scan backups path '%s': %w", cfg.Source, err)
+	}
+	return inv, nil
+}
+
+// runScan writes the inventory of the source to stdout, or to -scan-out, and
+// returns the process exit code.
+func runScan(cfg Config) int {
+	inv, err := scanSource(cfg)
+	if err != nil {
+		log.Printf("Error scanning source: %v", err)
+		return exitFailure
+	}
+	data, err := json.MarshalIndent(inv, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding inventory: %v", err)
+		return exitFailure
+	}
+	data = append(data, '\n')
+	if cfg.ScanOut == "" {
+		os.Stdout.Write(data)
+		return exitSuccess
+	}
+	if err := writeFileAtomic(cfg.ScanOut, data, 0644); err != nil {
+		log.Printf("Error writing inventory: %v", err)
+		return exitFailure
+	}
+	log.Printf("Wrote inventory of %d files (%s) to %s", inv.Files, formatBytes(inv.Bytes), cfg.ScanOut)
+	return exitSuccess
+}
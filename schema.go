@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// schemaURI is the JSON Schema dialect written by -print-schema.
+const schemaURI = "https://json-schema.org/draft/2020-12/schema"
+
+// printSchema writes a JSON Schema describing the -report output of backups
+// (Result) and restores (RestoreResult) and the metadata sidecar (Metadata)
+// to w. All are defined under $defs, so a document is validated against e.g.
+// "#/$defs/Result" or "#/$defs/Metadata". The schema is generated from the
+// structs, so it changes along with them.
+func printSchema(w io.Writer) error {
+	defs := map[string]any{}
+	for _, v := range []any{Result{}, RestoreResult{}, Metadata{}} {
+		schemaFor(reflect.TypeOf(v), defs)
+	}
+	doc := map[string]any{
+		"$schema": schemaURI,
+		"title":   "VaultwardenBackup report and metadata",
+		"$defs":   defs,
+	}
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode schema: %w", err)
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
+
+// schemaFor returns the schema of values of type t as encoding/json writes
+// them. Named structs are added to defs once and referenced from there.
+func schemaFor(t reflect.Type, defs map[string]any) map[string]any {
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+	switch t.Kind() {
+	case reflect.Pointer:
+		return schemaFor(t.Elem(), defs)
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice:
+		// A nil slice is written as null.
+		return map[string]any{"type": []string{"array", "null"}, "items": schemaFor(t.Elem(), defs)}
+	case reflect.Array:
+		return map[string]any{"type": "array", "items": schemaFor(t.Elem(), defs)}
+	case reflect.Map:
+		return map[string]any{"type": []string{"object", "null"}, "additionalProperties": schemaFor(t.Elem(), defs)}
+	case reflect.Struct:
+		name := t.Name()
+		if name == "" {
+			return structSchema(t, defs)
+		}
+		if _, ok := defs[name]; !ok {
+			defs[name] = nil // placeholder, in case the struct refers to itself
+			defs[name] = structSchema(t, defs)
+		}
+		return map[string]any{"$ref": "#/$defs/" + name}
+	}
+	return map[string]any{}
+}
+
+// structSchema describes a struct as an object with one property per
+// exported field. Fields without omitempty are always written, so they are
+// required.
+func structSchema(t reflect.Type, defs map[string]any) map[string]any {
+	properties := map[string]any{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = schemaFor(field.Type, defs)
+		if !strings.Contains(options, "omitempty") {
+			required = append(required, name)
+		}
+	}
+	return map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"required":             required,
+		"additionalProperties": false,
+	}
+}
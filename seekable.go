@@ -0,0 +1,94 @@
+package main
+
+import (
+	"io"
+
+	seekable "github.com/SaveTheRbtz/zstd-seekable-format-go/pkg"
+	"github.com/klauspost/compress/zstd"
+)
+
+// seekableFrameSize is the amount of uncompressed data in each frame of a
+// -seekable archive. Smaller frames make random access cheaper but compress
+// slightly worse, since every frame is compressed on its own.
+const seekableFrameSize = 1 << 20
+
+// seekableWriter compresses into the zstd seekable format: a series of
+// independent frames of seekableFrameSize followed by a skippable frame
+// holding the seek table. Decoders that do not know the format simply skip
+// the table, so the result is still a normal zstd stream.
+type seekableWriter struct {
+	w       seekable.Writer
+	encoder *zstd.Encoder
+	buf     []byte
+}
+
+func newSeekableWriter(w io.Writer, opts ...zstd.EOption) (*seekableWriter, error) {
+	encoder, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, err
+	}
+	sw, err := seekable.NewWriter(w, encoder)
+	if err != nil {
+		encoder.Close()
+		return nil, err
+	}
+	return &seekableWriter{w: sw, encoder: encoder, buf: make([]byte, 0, seekableFrameSize)}, nil
+}
+
+// Write buffers p and writes a frame every time seekableFrameSize bytes have
+// been collected, since the underlying writer turns each call into a frame.
+func (s *seekableWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), seekableFrameSize-len(s.buf))
+		s.buf = append(s.buf, p[:n]...)
+		p = p[n:]
+		written += n
+		if len(s.buf) == seekableFrameSize {
+			if err := s.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (s *seekableWriter) flush() error {
+	if len(s.buf) == 0 {
+		return nil
+	}
+	if _, err := s.w.Write(s.buf); err != nil {
+		return err
+	}
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// Close writes the last frame and the seek table.
+func (s *seekableWriter) Close() error {
+	defer s.encoder.Close()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	return s.w.Close()
+}
+
+// openSeekable returns a random access reader over the uncompressed content
+// of a seekable archive, or false if rs is not one (for example because it
+// is encrypted). rs is rewound in that case.
+func openSeekable(rs io.ReadSeeker) (seekable.Reader, func(), bool) {
+	decoder, err := zstd.NewReader(nil, decoderOptions()...)
+	if err != nil {
+		return nil, nil, false
+	}
+	reader, err := seekable.NewReader(rs, decoder)
+	if err != nil {
+		decoder.Close()
+		rs.Seek(0, io.SeekStart)
+		return nil, nil, false
+	}
+	return reader, func() {
+		reader.Close()
+		decoder.Close()
+	}, true
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+)
+
+// signatureSuffix is appended to a file's name to name its signature.
+const signatureSuffix = ".sig"
+
+// signOptions selects Ed25519ph: the SHA-512 of the file is signed rather
+// than the file itself, so archives of any size can be signed while being
+// streamed from disk.
+var signOptions = &ed25519.Options{Hash: crypto.SHA512}
+
+// loadSigningKey reads an Ed25519 private key from a PKCS #8 PEM file, as
+// written by "openssl genpkey -algorithm ed25519".
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	block, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse signing key '%s': %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("signing key '%s' is a %T, expected an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+// loadVerifyKey reads an Ed25519 public key from a PKIX PEM file, as written
+// by "openssl pkey -pubout".
+func loadVerifyKey(path string) (ed25519.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse public key '%s': %w", path, err)
+	}
+	edKey, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("public key '%s' is a %T, expected an Ed25519 key", path, key)
+	}
+	return edKey, nil
+}
+
+// readPEM returns the first PEM block of the given type in the file at path.
+func readPEM(path, blockType string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key file '%s': %w", path, err)
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("no %s PEM block found in '%s'", blockType, path)
+		}
+		if block.Type == blockType {
+			return block, nil
+		}
+	}
+}
+
+// fileDigest returns the SHA-512 of the file at path.
+func fileDigest(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open '%s' for signing: %w", path, err)
+	}
+	defer file.Close()
+	hasher := sha512.New()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return nil, fmt.Errorf("could not read '%s' for signing: %w", path, err)
+	}
+	return hasher.Sum(nil), nil
+}
+
+// signFile writes a base64 encoded signature of the file at path to
+// path.sig and returns the signature's path.
+func signFile(key ed25519.PrivateKey, path string) (string, error) {
+	digest, err := fileDigest(path)
+	if err != nil {
+		return "", err
+	}
+	sig, err := key.Sign(nil, digest, signOptions)
+	if err != nil {
+		return "", fmt.Errorf("failed to sign '%s': %w", path, err)
+	}
+	sigPath := path + signatureSuffix
+	data := base64.StdEncoding.EncodeToString(sig) + "\n"
+	if err := writeFileAtomic(sigPath, []byte(data), 0644); err != nil {
+		return "", fmt.Errorf("failed to write signature of '%s': %w", path, err)
+	}
+	return sigPath, nil
+}
+
+// verifyFileSignature checks the file at path against its path.sig.
+func verifyFileSignature(key ed25519.PublicKey, path string) error {
+	data, err := os.ReadFile(path + signatureSuffix)
+	if err != nil {
+		return fmt.Errorf("failed to read signature of '%s': %w", path, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data)))
+	if err != nil {
+		return fmt.Errorf("invalid signature file '%s': %w", path+signatureSuffix, err)
+	}
+	digest, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+	if err := ed25519.VerifyWithOptions(key, digest, sig, signOptions); err != nil {
+		return fmt.Errorf("signature of '%s' does not match: %w", path, err)
+	}
+	return nil
+}
+
+// signArchive signs the archive and, with -sign-manifest, its metadata
+// sidecar, and adds the signatures to the archive's sidecars.
+func signArchive(cfg Config, key ed25519.PrivateKey, arc *archive) error {
+	files := []string{arc.Path}
+	if cfg.SignManifest {
+		files = append(files, arc.Path+metadataSuffix)
+	}
+	for _, path := range files {
+		sigPath, err := signFile(key, path)
+		if err != nil {
+			return err
+		}
+		arc.Sidecars = append(arc.Sidecars, sigPath)
+	}
+	return nil
+}
+
+// runVerifySignature checks the signature of the file given with
+// -verify-signature and returns the process exit code. For an archive, the
+// signature of its metadata sidecar is checked too if there is one.
+func runVerifySignature(cfg Config) int {
+	key, err := loadVerifyKey(cfg.SignPub)
+	if err != nil {
+		log.Printf("Error verifying signature: %v", err)
+		return exitFailure
+	}
+	files := []string{cfg.VerifySignature}
+	manifest := cfg.VerifySignature + metadataSuffix
+	if _, err := os.Stat(manifest + signatureSuffix); err == nil {
+		files = append(files, manifest)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		log.Printf("Error verifying signature: %v", err)
+		return exitFailure
+	}
+	for _, path := range files {
+		if err := verifyFileSignature(key, path); err != nil {
+			log.Printf("Error verifying signature: %v", err)
+			return exitFailure
+		}
+		log.Printf("Signature OK: %s", path)
+	}
+	return exitSuccess
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// sourceSize is the result of measuring a source directory before archiving.
+type sourceSize struct {
+	Files int
+	Bytes int64
+}
+
+// sourceRoot is one directory being backed up. Prefix is prepended to the
+// names of its entries in the archive; it is empty for a plain -source.
+type sourceRoot struct {
+	Path   string
+	Prefix string
+}
+
+// resolveSources validates the -source value and returns the directories to
+// back up. A source containing glob characters, such as
+// /srv/vaultwarden-*/data, is expanded and must match at least one directory.
+// Each match is then stored under its path below the glob's fixed part
+// (e.g. vaultwarden-a/data/...), so all matches fit in one archive.
+func resolveSources(source string) ([]sourceRoot, error) {
+	if !hasGlobMeta(source) {
+		if err := checkSourceDir(source); err != nil {
+			return nil, err
+		}
+		return []sourceRoot{{Path: source}}, nil
+	}
+
+	matches, err := filepath.Glob(source)
+	if err != nil {
+		return nil, fmt.Errorf("invalid backups path pattern '%s': %w", source, err)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("backups path pattern '%s' did not match anything", source)
+	}
+	base := globBase(source)
+	var roots []sourceRoot
+	for _, match := range matches {
+		if err := checkSourceDir(match); err != nil {
+			return nil, err
+		}
+		rel, err := filepath.Rel(base, match)
+		if err != nil {
+			return nil, fmt.Errorf("could not calculate relative path for '%s': %w", match, err)
+		}
+		roots = append(roots, sourceRoot{Path: match, Prefix: filepath.ToSlash(rel)})
+	}
+	log.Printf("Backups path pattern '%s' matched %d directories", source, len(roots))
+	return roots, nil
+}
+
+// checkSourceDir verifies that path exists and is a directory.
+func checkSourceDir(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return fmt.Errorf("failed to read backups path '%s': %w", path, err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("backups path '%s' is not a directory", path)
+	}
+	return nil
+}
+
+// hasGlobMeta reports whether path contains any glob characters. The volume
+// name is left out, so the ? of a Windows long path such as \\?\C:\data is
+// not taken for one.
+func hasGlobMeta(path string) bool {
+	return strings.ContainsAny(path[len(filepath.VolumeName(path)):], "*?[")
+}
+
+// checkDriveRelative rejects Windows paths such as C:data, which are relative
+// to the current directory of the drive rather than to its root. Other
+// systems have no volume names, so it never fails there.
+func checkDriveRelative(flagName, path string) error {
+	if vol := filepath.VolumeName(path); vol != "" && !filepath.IsAbs(path) {
+		return fmt.Errorf("-%s '%s' is relative to the current directory of drive %s, use %s\\ for the root of the drive", flagName, path, vol, vol)
+	}
+	return nil
+}
+
+// readLink returns the target of a symlink with slashes as separators, the
+// form it is stored in archives, so links made on Windows restore elsewhere.
+func readLink(path string) (string, error) {
+	link, err := os.Readlink(path)
+	return filepath.ToSlash(link), err
+}
+
+// globBase returns the leading directories of a glob pattern that contain no
+// glob characters, e.g. /srv for /srv/vaultwarden-*/data.
+func globBase(pattern string) string {
+	base := pattern
+	for hasGlobMeta(base) {
+		base = filepath.Dir(base)
+	}
+	return base
+}
+
+// walkSource walks every source root and calls fn for each entry that passes
+// the filter, with the entry's slash separated name in the archive. Entries
+// left out by the filter are passed to onExclude, which may be nil. Filters
+// see names relative to their own root, without the root's prefix.
+//
+// Symlinks are passed to fn as they are, unless the filter follows them
+// (-follow-symlinks): then fn gets the info of the target, and directories
+// behind links are walked too. Broken links are still passed as symlinks.
+// A directory whose real path was already walked is skipped, so a link back
+// to a parent cannot make the walk loop forever.
+//
+// The entries of all roots are collected first and passed to fn sorted
+// byte-wise by name, so the order of an archive depends neither on the order
+// of the roots nor on the locale, and a directory always comes before its
+// content. Only names and file info are held, never file content.
+//
+// With -fast-scan the directories are read concurrently, see walkConcurrent.
+// Excluded entries are then passed to onExclude after the walk, sorted by
+// name as well, so the log does not depend on the scheduling either.
+func walkSource(roots []sourceRoot, filter *sourceFilter, onExclude func(name string, info os.FileInfo), fn func(path, name string, info os.FileInfo) error) error {
+	var mu sync.Mutex
+	var entries, excluded []sourceEntry
+	collect := func(path, name string, info os.FileInfo) error {
+		mu.Lock()
+		defer mu.Unlock()
+		entries = append(entries, sourceEntry{path: path, name: name, info: info})
+		return nil
+	}
+	concurrent := filter.fastScan && !filter.followSymlinks
+	exclude := onExclude
+	if concurrent && onExclude != nil {
+		exclude = func(name string, info os.FileInfo) {
+			mu.Lock()
+			defer mu.Unlock()
+			excluded = append(excluded, sourceEntry{name: name, info: info})
+		}
+	}
+	for _, root := range roots {
+		w := sourceWalker{root: root, filter: filter, onExclude: exclude, fn: collect}
+		if filter.followSymlinks {
+			w.visited = map[string]bool{}
+		}
+		info, err := os.Lstat(root.Path)
+		if err != nil {
+			return err
+		}
+		if concurrent {
+			err = w.walkConcurrent(root.Path, info)
+		} else {
+			err = w.walk(root.Path, info)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	sort.SliceStable(excluded, func(i, j int) bool { return excluded[i].name < excluded[j].name })
+	for _, entry := range excluded {
+		onExclude(entry.name, entry.info)
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	for _, entry := range entries {
+		if err := fn(entry.path, entry.name, entry.info); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// specialFileType returns the kind of special file mode describes, e.g.
+// "fifo" or "socket", and "" for regular files, directories and symlinks.
+func specialFileType(mode os.FileMode) string {
+	switch {
+	case mode&os.ModeNamedPipe != 0:
+		return "fifo"
+	case mode&os.ModeSocket != 0:
+		return "socket"
+	case mode&os.ModeCharDevice != 0:
+		return "character device"
+	case mode&os.ModeDevice != 0:
+		return "block device"
+	case mode&os.ModeIrregular != 0:
+		return "irregular file"
+	}
+	return ""
+}
+
+// archivableSpecial reports whether a special file can be stored as a tar
+// entry: FIFOs and device nodes can, sockets and irregular files cannot.
+func archivableSpecial(mode os.FileMode) bool {
+	return mode&(os.ModeNamedPipe|os.ModeDevice) != 0
+}
+
+// sourceEntry is an entry found by walkSource.
+type sourceEntry struct {
+	path string
+	name string
+	info os.FileInfo
+}
+
+// sourceWalker walks one source root for walkSource.
+type sourceWalker struct {
+	root      sourceRoot
+	filter    *sourceFilter
+	onExclude func(name string, info os.FileInfo)
+	fn        func(path, name string, info os.FileInfo) error
+	visited   map[string]bool // real paths of walked directories, when following symlinks
+}
+
+func (w *sourceWalker) walk(path string, info os.FileInfo) error {
+	descend, err := w.visit(path, info)
+	if err != nil || !descend {
+		return err
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		child := filepath.Join(path, entry.Name())
+		childInfo, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if err := w.walk(child, childInfo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fastScanWorkers is the number of directories -fast-scan reads at the same
+// time. Reading a directory is mostly waiting for the file system, so this
+// is well above the number of CPUs.
+const fastScanWorkers = 32
+
+// walkConcurrent is walk for -fast-scan: every directory is read in its own
+// goroutine, at most fastScanWorkers at a time, which speeds up trees with
+// hundreds of thousands of small files such as a large icon cache. w.fn and
+// w.onExclude are called from several goroutines and must be safe for that.
+// It is not used when following symlinks, as which of two paths to the same
+// directory gets archived would then depend on the scheduling.
+func (w *sourceWalker) walkConcurrent(root string, info os.FileInfo) error {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, fastScanWorkers)
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+	var scan func(path string, info os.FileInfo)
+	scan = func(path string, info os.FileInfo) {
+		if failed() {
+			return
+		}
+		descend, err := w.visit(path, info)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if !descend {
+			return
+		}
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			fail(err)
+			return
+		}
+		for _, entry := range entries {
+			child := filepath.Join(path, entry.Name())
+			childInfo, err := entry.Info()
+			if err != nil {
+				fail(err)
+				return
+			}
+			if !childInfo.IsDir() {
+				scan(child, childInfo)
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				sem <- struct{}{}
+				defer func() { <-sem }()
+				scan(child, childInfo)
+			}()
+		}
+	}
+	scan(root, info)
+	wg.Wait()
+	return firstErr
+}
+
+// visit filters the entry at path and passes it to w.fn. It reports whether
+// the entry is a directory whose content should be walked.
+func (w *sourceWalker) visit(path string, info os.FileInfo) (bool, error) {
+	relPath, err := filepath.Rel(w.root.Path, path)
+	if err != nil {
+		return false, fmt.Errorf("could not calculate relative path for '%s': %w", path, err)
+	}
+	relPath = filepath.ToSlash(relPath)
+
+	if w.visited != nil && info.Mode()&os.ModeSymlink != 0 {
+		if target, err := os.Stat(path); err == nil {
+			info = target
+		}
+	}
+	if path != w.root.Path && w.filter.skip(relPath, info) {
+		if w.onExclude != nil {
+			w.onExclude(relPath, info)
+		}
+		return false, nil
+	}
+	if kind := specialFileType(info.Mode()); kind != "" && (w.filter.skipSpecial || !archivableSpecial(info.Mode())) {
+		log.Printf("Warning: skipping %s '%s'", kind, logName(relPath))
+		return false, nil
+	}
+	if info.IsDir() && w.visited != nil {
+		real, err := filepath.EvalSymlinks(path)
+		if err != nil {
+			return false, fmt.Errorf("could not resolve '%s': %w", path, err)
+		}
+		if w.visited[real] {
+			log.Printf("Skipping '%s', it links to '%s' which is already archived", relPath, real)
+			return false, nil
+		}
+		w.visited[real] = true
+	}
+
+	descend := info.IsDir()
+	if descend && path != w.root.Path && w.filter.oneFilesystem {
+		if descend, err = w.sameFilesystem(path, relPath); err != nil {
+			return false, err
+		}
+	}
+
+	if path != w.root.Path || w.root.Prefix != "" {
+		name := w.root.Prefix
+		if path != w.root.Path {
+			name = relPath
+			if w.root.Prefix != "" {
+				name = w.root.Prefix + "/" + relPath
+			}
+		}
+		if err := w.fn(path, name, info); err != nil {
+			return false, err
+		}
+	}
+	return descend, nil
+}
+
+// sameFilesystem implements -one-filesystem for the directory at path: it
+// reports whether the directory is on the same file system as its parent, or
+// is a mount point listed in -follow-mounts and should be walked anyway. The
+// directory of a mount point that is not followed is still archived, empty.
+func (w *sourceWalker) sameFilesystem(path, relPath string) (bool, error) {
+	dev, err := deviceID(path)
+	if err != nil {
+		return false, err
+	}
+	parent, err := deviceID(filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	if dev == parent {
+		return true, nil
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false, fmt.Errorf("could not resolve '%s': %w", path, err)
+	}
+	if w.filter.followMount(relPath, abs) {
+		log.Printf("Following '%s' onto another file system, it is listed in -follow-mounts", relPath)
+		return true, nil
+	}
+	log.Printf("Skipping the content of '%s', it is on another file system; list it in -follow-mounts to archive it", relPath)
+	return false, nil
+}
+
+// measureSource walks the source directory and sums the sizes of the regular
+// files that would be archived, without reading them.
+func measureSource(cfg Config) (sourceSize, error) {
+	var size sourceSize
+	roots, err := resolveSources(cfg.Source)
+	if err != nil {
+		return size, err
+	}
+	filter, err := newSourceFilter(cfg)
+	if err != nil {
+		return size, err
+	}
+	err = walkSource(roots, filter, nil, func(path, name string, info os.FileInfo) error {
+		if info.Mode().IsRegular() {
+			size.Files++
+			size.Bytes += info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return size, fmt.Errorf("failed to measure backups path '%s': %w", cfg.Source, err)
+	}
+	return size, nil
+}
+
+// checkSourceSize enforces -max-total-size. It returns an error if the
+// measured source is larger than the limit, unless -force is set, in which
+// case only a warning is logged.
+func checkSourceSize(cfg Config, size sourceSize) error {
+	if cfg.MaxTotalSize == 0 || size.Bytes <= int64(cfg.MaxTotalSize) {
+		return nil
+	}
+	msg := fmt.Sprintf("backups path '%s' holds %s in %d files, more than -max-total-size of %s",
+		cfg.Source, formatBytes(size.Bytes), size.Files, formatBytes(int64(cfg.MaxTotalSize)))
+	if cfg.Force {
+		log.Printf("Warning: %s, continuing because -force is set", msg)
+		return nil
+	}
+	return fmt.Errorf("%s (use -force to back it up anyway)", msg)
+}
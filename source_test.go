@@ -0,0 +1,73 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestArchiveEntryOrder(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  []string // slash separated, relative to the test directory
+		source string   // relative to the test directory, may be a glob
+		want   []string
+		err    string
+	}{
+		{
+			name:   "directory",
+			files:  []string{"data/b", "data/a/x", "data/Z", "data/a.txt", "data/a-1/y"},
+			source: "data",
+			want:   []string{"Z", "a", "a-1", "a-1/y", "a.txt", "a/x", "b"},
+		},
+		{
+			name:   "glob",
+			files:  []string{"srv/vw-b/data/db", "srv/vw-a/data/db", "srv/vw-a/data/z/key", "srv/other/data/db"},
+			source: "srv/vw-*/data",
+			want:   []string{"vw-a/data", "vw-a/data/db", "vw-a/data/z", "vw-a/data/z/key", "vw-b/data", "vw-b/data/db"},
+		},
+		{
+			name:   "glob with files and prefixes of each other",
+			files:  []string{"srv/vw-a/db", "srv/vw-a/attachments/1", "srv/vw-a.old/db", "srv/vw-ab/db", "srv/notes.txt"},
+			source: "srv/vw-a*",
+			want:   []string{"vw-a", "vw-a.old", "vw-a.old/db", "vw-a/attachments", "vw-a/attachments/1", "vw-a/db", "vw-ab", "vw-ab/db"},
+		},
+		{
+			name:   "file",
+			files:  []string{"data/db"},
+			source: "data/db",
+			err:    "is not a directory",
+		},
+		{
+			name:   "glob matching a file",
+			files:  []string{"srv/vw-a/db", "srv/vw-b"},
+			source: "srv/vw-*",
+			err:    "is not a directory",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			content := map[string]string{}
+			for _, name := range tt.files {
+				content[name] = name
+			}
+			writeFiles(t, dir, content)
+			cfg := testConfig(filepath.Join(dir, filepath.FromSlash(tt.source)), filepath.Join(dir, "backups"))
+			arc, err := createTarball(cfg, sourceSize{}, nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := archiveNames(t, arc.Path); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("archive entries\n got %q\nwant %q", got, tt.want)
+			}
+		})
+	}
+}
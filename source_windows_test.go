@@ -0,0 +1,93 @@
+//go:build windows
+
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestWindowsSourcePaths(t *testing.T) {
+	tests := []struct {
+		path          string
+		glob          bool
+		base          string // globBase, for globs
+		driveRelative bool
+	}{
+		{path: `C:\srv\vaultwarden\data`},
+		{path: `C:/srv/vaultwarden/data`},
+		{path: `C:\srv\vw-*\data`, glob: true, base: `C:\srv`},
+		{path: `C:\srv/vw-?\data`, glob: true, base: `C:\srv`},
+		{path: `\\?\C:\srv\data`},
+		{path: `\\?\C:\srv\vw-*`, glob: true, base: `\\?\C:\srv`},
+		{path: `\\nas\backups\vaultwarden`},
+		{path: `\\nas\backups\vw-[ab]`, glob: true, base: `\\nas\backups\`},
+		{path: `\srv\data`},
+		{path: `data\..\data`},
+		{path: `C:data`, driveRelative: true},
+		{path: `D:..\data`, driveRelative: true},
+	}
+	for _, tt := range tests {
+		if got := hasGlobMeta(tt.path); got != tt.glob {
+			t.Errorf("hasGlobMeta(%q) = %v, want %v", tt.path, got, tt.glob)
+		}
+		if tt.glob {
+			if got := globBase(tt.path); got != tt.base {
+				t.Errorf("globBase(%q) = %q, want %q", tt.path, got, tt.base)
+			}
+		}
+		err := checkDriveRelative("source", tt.path)
+		if (err != nil) != tt.driveRelative {
+			t.Errorf("checkDriveRelative(%q) = %v, want an error: %v", tt.path, err, tt.driveRelative)
+		}
+	}
+}
+
+func TestWindowsArchiveNames(t *testing.T) {
+	dir := t.TempDir()
+	writeFiles(t, dir, map[string]string{
+		"srv/vw-a/data/db.sqlite3":             "a",
+		"srv/vw-a/data/attachments/1/file.bin": "a",
+		"srv/vw-b/data/db.sqlite3":             "b",
+	})
+	tests := []struct {
+		name   string
+		source string
+		want   []string
+	}{
+		{
+			name:   "directory",
+			source: filepath.Join(dir, `srv\vw-a\data`),
+			want:   []string{"attachments", "attachments/1", "attachments/1/file.bin", "db.sqlite3"},
+		},
+		{
+			name:   "long path",
+			source: `\\?\` + filepath.Join(dir, `srv\vw-a\data`),
+			want:   []string{"attachments", "attachments/1", "attachments/1/file.bin", "db.sqlite3"},
+		},
+		{
+			name:   "glob with mixed separators",
+			source: filepath.Join(dir, "srv") + `\vw-*/data`,
+			want:   []string{"vw-a/data", "vw-a/data/attachments", "vw-a/data/attachments/1", "vw-a/data/attachments/1/file.bin", "vw-a/data/db.sqlite3", "vw-b/data", "vw-b/data/db.sqlite3"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			arc, err := createTarball(testConfig(tt.source, t.TempDir()), sourceSize{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := archiveNames(t, arc.Path)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("archive entries\n got %q\nwant %q", got, tt.want)
+			}
+			for _, name := range got {
+				if strings.Contains(name, `\`) {
+					t.Errorf("archive entry %q has a backslash", name)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !linux && !darwin && !freebsd
+
+package main
+
+import (
+	"archive/tar"
+	"fmt"
+)
+
+// makeSpecial is not implemented on this platform, which has no FIFOs or
+// device nodes in its file system.
+func makeSpecial(path string, header *tar.Header) error {
+	return fmt.Errorf("%s entries are not supported on this platform", entryType(header.Typeflag))
+}
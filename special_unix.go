@@ -0,0 +1,23 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"archive/tar"
+
+	"golang.org/x/sys/unix"
+)
+
+// makeSpecial creates the FIFO or device node of a tar entry at path. Device
+// nodes need root.
+func makeSpecial(path string, header *tar.Header) error {
+	perm := uint32(header.FileInfo().Mode().Perm())
+	switch header.Typeflag {
+	case tar.TypeFifo:
+		return unix.Mkfifo(path, perm)
+	case tar.TypeChar:
+		return mknod(path, unix.S_IFCHR|perm, unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+	default:
+		return mknod(path, unix.S_IFBLK|perm, unix.Mkdev(uint32(header.Devmajor), uint32(header.Devminor)))
+	}
+}
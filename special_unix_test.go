@@ -0,0 +1,77 @@
+//go:build linux || darwin || freebsd
+
+package main
+
+import (
+	"archive/tar"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestArchiveFIFO(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"db.sqlite3": "database"})
+	if err := unix.Mkfifo(filepath.Join(source, "pipe"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, skip := range []bool{false, true} {
+		cfg := testConfig(source, t.TempDir())
+		cfg.SkipSpecial = skip
+		// Opening a FIFO blocks until it has a writer, so a backup that
+		// tries to read it never finishes.
+		type result struct {
+			arc *archive
+			err error
+		}
+		done := make(chan result, 1)
+		go func() {
+			arc, err := createTarball(cfg, sourceSize{}, nil)
+			done <- result{arc, err}
+		}()
+		var res result
+		select {
+		case res = <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("backup with -skip-special=%v blocked on the FIFO", skip)
+		}
+		if res.err != nil {
+			t.Fatal(res.err)
+		}
+
+		types := map[string]byte{}
+		for _, header := range archiveHeaders(t, res.arc.Path) {
+			types[header.Name] = header.Typeflag
+		}
+		if types["db.sqlite3"] != tar.TypeReg {
+			t.Errorf("db.sqlite3 is missing from the archive with -skip-special=%v", skip)
+		}
+		typeflag, found := types["pipe"]
+		if skip {
+			if found {
+				t.Errorf("FIFO archived despite -skip-special")
+			}
+			continue
+		}
+		if typeflag != tar.TypeFifo {
+			t.Fatalf("FIFO archived as %s, want %s", entryType(typeflag), entryType(tar.TypeFifo))
+		}
+
+		to := t.TempDir()
+		restored := RestoreTarball(RestoreOptions{Archive: res.arc.Path, To: to, Policy: policySkip})
+		if !restored.Success {
+			t.Fatalf("restore failed: %s", restored.Error)
+		}
+		info, err := os.Lstat(filepath.Join(to, "pipe"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode()&os.ModeNamedPipe == 0 {
+			t.Errorf("restored FIFO has mode %s, want a named pipe", info.Mode())
+		}
+	}
+}
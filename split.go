@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// splitManifestSuffix is appended to the name of a -stream-split archive for
+// the manifest that lists its parts.
+const splitManifestSuffix = ".parts.json"
+
+// splitManifest describes an archive that was uploaded in parts with
+// -stream-split. The archive itself never exists as one file; it is the
+// concatenation of the parts in index order.
+type splitManifest struct {
+	Archive    string      `json:"archive"`
+	HashAlg    string      `json:"hash_alg"`
+	Hash       string      `json:"hash"`
+	SHA256     string      `json:"sha256,omitempty"`
+	Size       int64       `json:"size"`
+	PartSize   int64       `json:"part_size"`
+	Created    time.Time   `json:"created"`
+	Parts      []splitPart `json:"parts"`
+	Reassemble string      `json:"reassemble"`
+}
+
+// splitPart is one uploaded part of a -stream-split archive.
+type splitPart struct {
+	Index int    `json:"index"`
+	Key   string `json:"key"`
+	Size  int64  `json:"size"`
+	CRC32 string `json:"crc32"`
+}
+
+// splitWriter cuts the archive stream into parts of at most size bytes. Each
+// part is staged in a temporary file in the target directory and uploaded to
+// every destination as soon as it is full, then removed, so no more than one
+// part is ever on local disk. A destination that fails an upload is dropped
+// for the rest of the archive; the archive fails once none is left.
+type splitWriter struct {
+	ctx   context.Context
+	cfg   Config
+	dests []Destination
+	// prefix is the rendered -remote-prefix-template and base the name of
+	// the parts without their index, both fixed when the archive starts.
+	prefix string
+	base   string
+	size   int64
+
+	file    *os.File
+	crc     hash.Hash32
+	n       int64
+	total   int64
+	parts   []splitPart
+	failed  []bool
+	results []UploadResult
+}
+
+// newSplitWriter starts a -stream-split archive. As the hash of the archive
+// is only known at the end, the parts are named after the date and a random
+// id, e.g. 06-01-2024-split-1a2b3c4d.tar.zstd.0001.
+func newSplitWriter(ctx context.Context, cfg Config, dests []Destination) (*splitWriter, error) {
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate split archive id: %w", err)
+	}
+	fields := newNameFields(time.Now(), "split-"+hex.EncodeToString(id), cfg.Extension)
+	fields.Label = cfg.Label
+	if cfg.Passphrase != "" {
+		fields.Ext += encryptedExtension
+	}
+	tmpl, err := parsePrefixTemplate(cfg.RemotePrefixTemplate)
+	if err != nil {
+		return nil, err
+	}
+	prefix, err := renderPrefix(tmpl, fields)
+	if err != nil {
+		return nil, err
+	}
+	return &splitWriter{
+		ctx:    ctx,
+		cfg:    cfg,
+		dests:  dests,
+		prefix: prefix,
+		base:   fields.filename(),
+		size:   int64(cfg.StreamSplit),
+		failed: make([]bool, len(dests)),
+	}, nil
+}
+
+// Write stages p in the current part, uploading each part that fills up.
+func (w *splitWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if w.file == nil {
+			file, err := createTemp(w.cfg.Target, "part-*.tmp", w.cfg.DeterministicTempName)
+			if err != nil {
+				return written, fmt.Errorf("failed to create temporary file for part %d: %w", len(w.parts)+1, err)
+			}
+			w.file, w.crc, w.n = file, crc32.NewIEEE(), 0
+		}
+		chunk := p[:min(int64(len(p)), w.size-w.n)]
+		n, err := io.MultiWriter(w.file, w.crc).Write(chunk)
+		written += n
+		w.n += int64(n)
+		w.total += int64(n)
+		if err != nil {
+			return written, fmt.Errorf("failed to write part %d: %w", len(w.parts)+1, err)
+		}
+		p = p[n:]
+		if w.n == w.size {
+			if err := w.upload(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// upload sends the current part to every destination that has not failed
+// yet, then removes its temporary file.
+func (w *splitWriter) upload() error {
+	defer w.abort()
+	part := splitPart{
+		Index: len(w.parts) + 1,
+		Size:  w.n,
+		CRC32: hashDigest(w.crc),
+	}
+	part.Key = fmt.Sprintf("%s%s.%04d", w.prefix, w.base, part.Index)
+	if err := w.store(part.Key, w.file.Name()); err != nil {
+		return err
+	}
+	w.parts = append(w.parts, part)
+	return nil
+}
+
+// store uploads the file at path under key to every destination that has not
+// failed yet. It fails if no destination is left.
+func (w *splitWriter) store(key, path string) error {
+	stored := 0
+	for i, dest := range w.dests {
+		if w.failed[i] {
+			w.results = append(w.results, UploadResult{Destination: dest.Name(), Key: key})
+			continue
+		}
+		result := uploadOutcome(w.ctx, w.cfg, dest, key, path, storeFile(w.ctx, dest, key, path))
+		w.results = append(w.results, result)
+		if result.Error != "" {
+			w.failed[i] = true
+			log.Printf("Warning: not uploading the rest of the split archive to %s", dest.Name())
+			continue
+		}
+		stored++
+	}
+	if stored == 0 {
+		return fmt.Errorf("%w: '%s' could not be uploaded to any remote", errUploadFailed, key)
+	}
+	return nil
+}
+
+// abort removes the temporary file of the current part, if any.
+func (w *splitWriter) abort() {
+	if w.file != nil {
+		w.file.Close()
+		os.Remove(w.file.Name())
+		w.file = nil
+	}
+}
+
+// finish uploads the last part, then writes the manifest into dir and uploads
+// it too, under the same prefix as the parts. It returns the path of the
+// manifest.
+func (w *splitWriter) finish(arc *archive, dir string) (string, error) {
+	if w.file != nil && w.n > 0 {
+		if err := w.upload(); err != nil {
+			return "", err
+		}
+	}
+	names := make([]string, len(w.parts))
+	for i, part := range w.parts {
+		names[i] = filepath.Base(part.Key)
+	}
+	archiveName := arc.Fields.filename()
+	manifest := splitManifest{
+		Archive:  archiveName,
+		HashAlg:  w.cfg.HashAlgorithm,
+		Hash:     arc.Hash,
+		SHA256:   arc.SHA256,
+		Size:     w.total,
+		PartSize: w.size,
+		Created:  time.Now(),
+		Parts:    w.parts,
+		Reassemble: fmt.Sprintf("Download the %d parts and concatenate them in index order into %s, e.g. 'cat %s > %s', check that the CRC32 of each part and the %s of the result match this manifest, then restore it with -restore",
+			len(w.parts), archiveName, strings.Join(names, " "), archiveName, w.cfg.HashAlgorithm),
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to encode split manifest: %w", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create archive directory '%s': %w", dir, err)
+	}
+	path := filepath.Join(dir, archiveName+splitManifestSuffix)
+	if err := writeFileAtomic(path, append(data, '\n'), 0644); err != nil {
+		return "", fmt.Errorf("failed to write split manifest: %w", err)
+	}
+	if err := w.store(w.prefix+filepath.Base(path), path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// err reports the destinations that dropped out during the upload, which
+// hold an incomplete archive.
+func (w *splitWriter) err() error {
+	var failed []string
+	for i, dest := range w.dests {
+		if w.failed[i] {
+			failed = append(failed, dest.Name())
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("%w: the split archive is incomplete on %s", errUploadFailed, strings.Join(failed, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// stateFileName is the name of the file in the target directory that carries
+// information between separate invocations (e.g. hourly cron runs).
+const stateFileName = ".vwb-state.json"
+
+// runState is the durable state persisted in the target directory.
+type runState struct {
+	// LastSuccessNotify is when the last success notification was sent.
+	LastSuccessNotify time.Time `json:"last_success_notify,omitempty"`
+	// SourceDevices are the devices of the source directories in the last
+	// successful run, recorded with -detect-remount.
+	SourceDevices map[string]uint64 `json:"source_devices,omitempty"`
+	// FailedRuns counts the runs that failed in a row since FailingSince,
+	// and FailureNotified records that the first of them was notified,
+	// tracked with -notify-transitions.
+	FailedRuns      int       `json:"failed_runs,omitempty"`
+	FailingSince    time.Time `json:"failing_since,omitempty"`
+	FailureNotified bool      `json:"failure_notified,omitempty"`
+}
+
+// loadState reads the state file from the target directory. A missing file is
+// not an error and yields an empty state.
+func loadState(targetDir string) (runState, error) {
+	var state runState
+	data, err := os.ReadFile(filepath.Join(targetDir, stateFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	}
+	if err != nil {
+		return state, fmt.Errorf("failed to read state file: %w", err)
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return state, fmt.Errorf("failed to parse state file: %w", err)
+	}
+	return state, nil
+}
+
+// saveState writes the state file to the target directory. The file is written
+// to a temporary name first and renamed, so a concurrent reader never sees a
+// partially written state.
+func saveState(targetDir string, state runState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	return writeFileAtomic(filepath.Join(targetDir, stateFileName), data, 0644)
+}
+
+// deterministicTempPart replaces the * of a temporary file pattern with
+// -deterministic-temp-name.
+const deterministicTempPart = "vwb"
+
+// createTemp creates a new temporary file in dir like os.CreateTemp. With
+// deterministic set the * in pattern is replaced by deterministicTempPart
+// instead of a random string, so the name is known in advance; a file left
+// over under that name, e.g. by -keep-partial-on-error, is replaced. Callers
+// hold the run lock, so no other run uses the same name at the same time.
+func createTemp(dir, pattern string, deterministic bool) (*os.File, error) {
+	if !deterministic {
+		return os.CreateTemp(dir, pattern)
+	}
+	path := filepath.Join(dir, strings.Replace(pattern, "*", deterministicTempPart, 1))
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0600)
+	if errors.Is(err, os.ErrExist) {
+		log.Printf("Warning: replacing leftover temporary file '%s'", path)
+		file, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	}
+	return file, err
+}
+
+// writeFileAtomic writes data to a temporary file next to path and renames it
+// into place once it is complete.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return writeStreamAtomic(path, bytes.NewReader(data), perm)
+}
+
+// writeStreamAtomic copies r into a temporary file next to path and renames
+// it into place once it is complete.
+func writeStreamAtomic(path string, r io.Reader, perm os.FileMode) error {
+	tempFile, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file for '%s': %w", path, err)
+	}
+	defer os.Remove(tempFile.Name()) // Clean up temp file on error
+	defer tempFile.Close()
+
+	if _, err := io.Copy(tempFile, r); err != nil {
+		return fmt.Errorf("failed to write temporary file for '%s': %w", path, err)
+	}
+	if err := tempFile.Chmod(perm); err != nil {
+		return fmt.Errorf("failed to set permissions on '%s': %w", path, err)
+	}
+	if err := tempFile.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file for '%s': %w", path, err)
+	}
+	if err := os.Rename(tempFile.Name(), path); err != nil {
+		return fmt.Errorf("failed to rename temporary file to '%s': %w", path, err)
+	}
+	return nil
+}
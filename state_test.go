@@ -0,0 +1,38 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCreateTempDeterministic(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "part-"+deterministicTempPart+".tmp")
+	if err := os.WriteFile(leftover, []byte("left over by an earlier run"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := createTemp(dir, "part-*.tmp", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if file.Name() != leftover {
+		t.Errorf("createTemp created %s, want %s", file.Name(), leftover)
+	}
+	if info, err := file.Stat(); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 0 {
+		t.Errorf("leftover temporary file was not truncated, it has %d bytes", info.Size())
+	}
+
+	random, err := createTemp(dir, "part-*.tmp", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer random.Close()
+	if random.Name() == leftover {
+		t.Errorf("createTemp without deterministic names reused %s", leftover)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// trashDirName is the directory in the target that -prune-to-trash moves
+// pruned archives to, unless -trash-dir names another one. listArchives
+// leaves it alone, and the -trash-dir too if it is inside the target, so
+// trashed archives are neither listed nor pruned again.
+const trashDirName = ".trash"
+
+// trashTimeFormat names the subdirectory of the trash each archive is moved
+// into, recording when it was trashed.
+const trashTimeFormat = "2006-01-02T15-04-05"
+
+// trashDir returns the trash directory for cfg.
+func trashDir(cfg Config) string {
+	if cfg.TrashDir != "" {
+		return cfg.TrashDir
+	}
+	return filepath.Join(cfg.Target, trashDirName)
+}
+
+// trashMatcher returns a function that reports whether a directory found
+// while walking the target is a trash directory: any directory named
+// trashDirName, or trash itself if it is not empty and exists.
+func trashMatcher(trash string) func(entry fs.DirEntry) bool {
+	var trashInfo os.FileInfo
+	if trash != "" {
+		trashInfo, _ = os.Stat(trash)
+	}
+	return func(entry fs.DirEntry) bool {
+		if entry.Name() == trashDirName {
+			return true
+		}
+		if trashInfo == nil {
+			return false
+		}
+		info, err := entry.Info()
+		return err == nil && os.SameFile(info, trashInfo)
+	}
+}
+
+// moveToTrash moves an archive and its sidecars into a subdirectory of trash
+// named after the current time, and returns the number of bytes moved. The
+// trash must be on the same file system as the archive.
+func moveToTrash(a storedArchive, trash string) (int64, error) {
+	dir := filepath.Join(trash, time.Now().Format(trashTimeFormat))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return 0, fmt.Errorf("failed to create trash directory '%s': %w", dir, err)
+	}
+	var moved int64
+	for _, suffix := range append([]string{""}, archiveSidecarSuffixes...) {
+		path := a.Path + suffix
+		info, err := os.Stat(path)
+		if suffix != "" && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return moved, fmt.Errorf("failed to stat '%s': %w", path, err)
+		}
+		if err := os.Rename(path, filepath.Join(dir, filepath.Base(path))); err != nil {
+			return moved, fmt.Errorf("failed to move '%s' to the trash: %w", path, err)
+		}
+		moved += info.Size()
+	}
+	return moved, nil
+}
+
+// sweepTrash permanently deletes what was moved to the trash more than
+// retention ago, and returns the number of trash subdirectories removed.
+// Entries not created by moveToTrash are left alone.
+func sweepTrash(trash string, retention time.Duration) (int, error) {
+	entries, err := os.ReadDir(trash)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("failed to read trash directory '%s': %w", trash, err)
+	}
+	swept := 0
+	for _, entry := range entries {
+		trashed, err := time.ParseInLocation(trashTimeFormat, entry.Name(), time.Local)
+		if err != nil || !entry.IsDir() || time.Since(trashed) < retention {
+			continue
+		}
+		path := filepath.Join(trash, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			return swept, fmt.Errorf("failed to empty '%s' from the trash: %w", path, err)
+		}
+		log.Printf("Deleted from trash after %s: %s", retention, path)
+		swept++
+	}
+	return swept, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// vaultwardenKeyFiles are the RSA key files Vaultwarden signs login tokens
+// with. A backup without them restores the vault, but every session and
+// device has to log in again.
+var vaultwardenKeyFiles = []string{"rsa_key.pem", "rsa_key.pub.pem"}
+
+// checkVaultwardenFiles looks at every source directory that holds a
+// Vaultwarden database and reports the key files that are missing from it,
+// or that the filter would leave out of the archive. Missing files are a
+// warning, or an error with -strict. Directories without a database are not
+// checked, as they do not look like a Vaultwarden data directory.
+func checkVaultwardenFiles(cfg Config, roots []sourceRoot, filter *sourceFilter) error {
+	var missing []string
+	for _, root := range roots {
+		if _, err := os.Stat(filepath.Join(root.Path, vaultwardenDBName)); err != nil {
+			continue
+		}
+		for _, name := range vaultwardenKeyFiles {
+			path := filepath.Join(root.Path, name)
+			info, err := os.Stat(path)
+			if err != nil {
+				missing = append(missing, path)
+			} else if filter.skip(name, info) {
+				missing = append(missing, path+" (excluded)")
+			}
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("the source holds a Vaultwarden database but these key files would not be backed up: %s", strings.Join(missing, ", "))
+	if cfg.Strict {
+		return fmt.Errorf("%s (without -strict this is only a warning)", msg)
+	}
+	log.Printf("Warning: %s. Restoring such a backup logs out every session", msg)
+	return nil
+}
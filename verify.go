@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// md5Checker is implemented by destinations that can report a reliable MD5 of
+// a stored object without downloading it. ok is false when the destination
+// has no trustworthy content hash for the object.
+type md5Checker interface {
+	RemoteMD5(ctx context.Context, key string) (sum string, ok bool, err error)
+}
+
+// verifyUpload checks that the object stored under key matches the local
+// file at path. It uses the destination's MD5 where available and otherwise
+// downloads the object again and compares SHA-256 digests.
+func verifyUpload(ctx context.Context, dest Destination, key, path string) error {
+	if checker, ok := dest.(md5Checker); ok {
+		remote, ok, err := checker.RemoteMD5(ctx, key)
+		if err != nil {
+			return err
+		}
+		if ok {
+			local, err := hashFile(path, md5.New())
+			if err != nil {
+				return err
+			}
+			if local != remote {
+				return fmt.Errorf("remote MD5 %s does not match local %s", remote, local)
+			}
+			return nil
+		}
+	}
+
+	local, err := hashFile(path, sha256.New())
+	if err != nil {
+		return err
+	}
+	stream, err := dest.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	hasher := sha256.New()
+	if _, err := io.Copy(hasher, stream); err != nil {
+		return fmt.Errorf("failed to download '%s' for verification: %w", key, err)
+	}
+	if remote := hex.EncodeToString(hasher.Sum(nil)); remote != local {
+		return fmt.Errorf("remote SHA-256 %s does not match local %s", remote, local)
+	}
+	return nil
+}
+
+// hashFile returns the hex digest of the file at path using hasher.
+func hashFile(path string, hasher hash.Hash) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("could not open '%s' for hashing: %w", path, err)
+	}
+	defer file.Close()
+	if _, err := io.Copy(hasher, file); err != nil {
+		return "", fmt.Errorf("could not read '%s' for hashing: %w", path, err)
+	}
+	return hex.EncodeToString(hasher.Sum(nil)), nil
+}
+
+// testArchive decodes the whole archive at path, failing on the first error.
+// The tar entries are read so a truncated stream is caught, and whatever
+// follows them, such as a seek table, is decompressed as well.
+func testArchive(path, passphrase string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open archive '%s': %w", path, err)
+	}
+	defer file.Close()
+	plain, err := newDecryptReader(file, passphrase)
+	if err != nil {
+		return err
+	}
+	zstdReader, err := zstd.NewReader(plain, decoderOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zstdReader.Close()
+	tarReader := tar.NewReader(zstdReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive test failed: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, tarReader); err != nil {
+			return fmt.Errorf("archive test failed in '%s': %w", header.Name, err)
+		}
+	}
+	if _, err := io.Copy(io.Discard, zstdReader); err != nil {
+		return fmt.Errorf("archive test failed: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// verifyOutcome is the result of checking one archive with -verify-all.
+type verifyOutcome struct {
+	Path string
+	// Checks lists what was checked, e.g. "decode" and "crc32".
+	Checks []string
+	// Skipped explains why an archive could not be checked at all.
+	Skipped string
+	Err     error
+}
+
+// verifyStoredArchive checks a local archive in a single read: the hash in
+// its filename, the SHA-256 of its .sha256 sidecar if there is one, and that
+// it decodes completely. The hash algorithm and stage are taken from the
+// metadata sidecar. Without one the algorithm is guessed by nameHashAlgorithm
+// and the stage is -hash-stage. An encrypted archive can only be decoded, and
+// checked against a pre-encrypt hash, with the passphrase; without it only
+// the post-encrypt checks are made.
+func verifyStoredArchive(cfg Config, path string) verifyOutcome {
+	out := verifyOutcome{Path: path}
+	fields, ok := parseArchiveName(filepath.Base(path))
+	if !ok {
+		out.Err = fmt.Errorf("'%s' is not named like an archive", path)
+		return out
+	}
+	algorithm, stage := nameHashAlgorithm(cfg, fields.Hash), cfg.HashStage
+	if meta, err := readMetadata(path); err == nil {
+		if meta.HashAlg != "" {
+			algorithm = meta.HashAlg
+		}
+		if meta.HashStage != "" {
+			stage = meta.HashStage
+		}
+	}
+	nameHasher, err := newNameHasher(algorithm)
+	if err != nil {
+		out.Err = err
+		return out
+	}
+	encrypted := strings.HasSuffix(fields.Ext, encryptedExtension)
+	preEncrypt := encrypted && stage == hashStagePreEncrypt
+	decode := !encrypted || cfg.Passphrase != ""
+
+	// 1. Read the sidecar, which names the decrypted archive for a
+	// pre-encrypt hash
+	var wantSHA256 string
+	if data, err := os.ReadFile(path + checksumSuffix); err == nil {
+		if f := strings.Fields(string(data)); len(f) > 0 {
+			wantSHA256 = f[0]
+		}
+	}
+
+	// 2. Set up the chain of readers, with the hashers before or after the
+	// decryption: file -> hashers -> decryption -> hashers -> zstd -> tar
+	file, err := os.Open(path)
+	if err != nil {
+		out.Err = fmt.Errorf("failed to open archive '%s': %w", path, err)
+		return out
+	}
+	defer file.Close()
+	hashers := []hash.Hash{nameHasher}
+	sha256Hasher := sha256.New()
+	if wantSHA256 != "" {
+		hashers = append(hashers, sha256Hasher)
+	}
+	var fileHashers, plainHashers []io.Writer
+	for _, h := range hashers {
+		if preEncrypt {
+			plainHashers = append(plainHashers, h)
+		} else {
+			fileHashers = append(fileHashers, h)
+		}
+	}
+	raw := io.TeeReader(file, io.MultiWriter(fileHashers...))
+	if preEncrypt && !decode {
+		out.Skipped = "its hash is pre-encrypt, set -passphrase-file or VWBPASSPHRASE to verify it"
+		return out
+	}
+	if decode {
+		if err := decodeForVerify(raw, cfg.Passphrase, io.MultiWriter(plainHashers...)); err != nil {
+			out.Err = err
+			return out
+		}
+		out.Checks = append(out.Checks, "decode")
+	}
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		out.Err = fmt.Errorf("failed to read archive '%s': %w", path, err)
+		return out
+	}
+
+	// 3. Compare the digests
+	if digest := hashDigest(nameHasher); !digestMatches(algorithm, digest, fields.Hash) {
+		out.Err = fmt.Errorf("%s of the archive is %s, but its name says %s", algorithm, digest, fields.Hash)
+		return out
+	}
+	out.Checks = append(out.Checks, algorithm)
+	if wantSHA256 != "" {
+		if got := hex.EncodeToString(sha256Hasher.Sum(nil)); got != wantSHA256 {
+			out.Err = fmt.Errorf("SHA-256 of the archive is %s, but its sidecar says %s", got, wantSHA256)
+			return out
+		}
+		out.Checks = append(out.Checks, "sha256")
+	}
+	return out
+}
+
+// nameHashAlgorithm guesses the algorithm of the hash in the name of an
+// archive without metadata. A hash as long as -hash makes it, in full or
+// truncated by -hash-truncate, is taken to be from -hash. Otherwise a hash
+// of the full length of another algorithm is from that one, and any other
+// length is a truncated -hash. The caller compares the digest by prefix, so
+// truncated hashes match too.
+func nameHashAlgorithm(cfg Config, nameHash string) string {
+	if len(nameHash) == cfg.HashTruncate || fullHashLength(cfg.HashAlgorithm, len(nameHash)) {
+		return cfg.HashAlgorithm
+	}
+	for _, algorithm := range []string{hashSHA256, hashXXHash, hashCRC32} {
+		if fullHashLength(algorithm, len(nameHash)) {
+			return algorithm
+		}
+	}
+	return cfg.HashAlgorithm
+}
+
+// fullHashLength reports whether n is the length of an untruncated digest of
+// algorithm. CRC32 digests are written without leading zeros, so any length
+// up to 8 is.
+func fullHashLength(algorithm string, n int) bool {
+	hasher, err := newNameHasher(algorithm)
+	if err != nil {
+		return false
+	}
+	if algorithm == hashCRC32 {
+		return n <= hasher.Size()*2
+	}
+	return n == hasher.Size()*2
+}
+
+// decodeForVerify decodes an archive stream completely, writing the
+// decrypted stream to plain as well.
+func decodeForVerify(r io.Reader, passphrase string, plain io.Writer) error {
+	decrypted, err := newDecryptReader(r, passphrase)
+	if err != nil {
+		return err
+	}
+	zstdReader, err := zstd.NewReader(io.TeeReader(decrypted, plain), decoderOptions()...)
+	if err != nil {
+		return fmt.Errorf("failed to create zstd reader: %w", err)
+	}
+	defer zstdReader.Close()
+	tarReader := tar.NewReader(zstdReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to decode archive: %w", err)
+		}
+		if _, err := io.Copy(io.Discard, tarReader); err != nil {
+			return fmt.Errorf("failed to decode '%s': %w", header.Name, err)
+		}
+	}
+	if _, err := io.Copy(io.Discard, zstdReader); err != nil {
+		return fmt.Errorf("failed to decode archive: %w", err)
+	}
+	// Pass the rest of the decrypted stream, if any, through the hashers.
+	if _, err := io.Copy(plain, decrypted); err != nil {
+		return fmt.Errorf("failed to decrypt archive: %w", err)
+	}
+	return nil
+}
+
+// verifyAllArchives checks every archive in the target directory, with up to
+// -verify-concurrency archives read at the same time. The outcomes are
+// returned in the order of the archives.
+func verifyAllArchives(cfg Config) ([]verifyOutcome, error) {
+	archives, err := listArchives(cfg.Target, trashDir(cfg))
+	if err != nil {
+		return nil, err
+	}
+	workers := cfg.VerifyConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	outcomes := make([]verifyOutcome, len(archives))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for range min(workers, len(archives)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				outcomes[i] = verifyStoredArchive(cfg, archives[i].Path)
+				switch {
+				case outcomes[i].Err != nil:
+					log.Printf("FAILED %s: %v", archives[i].Path, outcomes[i].Err)
+				case outcomes[i].Skipped != "":
+					log.Printf("SKIPPED %s: %s", archives[i].Path, outcomes[i].Skipped)
+				default:
+					log.Printf("OK %s (%s)", archives[i].Path, strings.Join(outcomes[i].Checks, ", "))
+				}
+			}
+		}()
+	}
+	for i := range archives {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	return outcomes, nil
+}
+
+// runVerifyAll runs -verify-all and returns the process exit code.
+func runVerifyAll(cfg Config) int {
+	log.Printf("--- Verifying all archives in %s ---", cfg.Target)
+	outcomes, err := verifyAllArchives(cfg)
+	if err != nil {
+		log.Printf("Error verifying archives: %v", err)
+		return exitFailure
+	}
+	var failed []string
+	skipped := 0
+	for _, o := range outcomes {
+		if o.Err != nil {
+			failed = append(failed, o.Path)
+		} else if o.Skipped != "" {
+			skipped++
+		}
+	}
+	log.Printf("Verified %d archives: %d ok, %d failed, %d skipped", len(outcomes), len(outcomes)-len(failed)-skipped, len(failed), skipped)
+	if len(failed) > 0 {
+		for _, path := range failed {
+			log.Printf("Failed: %s", path)
+		}
+		log.Println("--- Verification failed. ---")
+		return exitFailure
+	}
+	log.Println("--- All archives verified successfully! ---")
+	return exitSuccess
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestVerifyStoredArchiveWithoutMetadata(t *testing.T) {
+	source := t.TempDir()
+	writeFiles(t, source, map[string]string{"config.json": "{}"})
+	tests := []struct {
+		name      string
+		algorithm string
+		truncate  int
+		// verifyAlgorithm and verifyTruncate are -hash and -hash-truncate
+		// of the -verify-all run.
+		verifyAlgorithm string
+		verifyTruncate  int
+	}{
+		{"crc32", hashCRC32, 0, hashCRC32, 0},
+		{"sha256", hashSHA256, 0, hashCRC32, 0},
+		{"xxhash", hashXXHash, 0, hashCRC32, 0},
+		{"sha256 truncated to the length of xxhash", hashSHA256, 16, hashSHA256, 16},
+		{"sha256 truncated, verified with another truncation", hashSHA256, 12, hashSHA256, 20},
+		{"xxhash truncated to the length of crc32", hashXXHash, 8, hashXXHash, 8},
+		{"sha256 after switching to sha256 truncated", hashSHA256, 0, hashSHA256, 12},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := testConfig(source, t.TempDir())
+			cfg.HashAlgorithm, cfg.HashTruncate = tt.algorithm, tt.truncate
+			arc, err := createTarball(cfg, sourceSize{}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg.HashAlgorithm, cfg.HashTruncate = tt.verifyAlgorithm, tt.verifyTruncate
+			out := verifyStoredArchive(cfg, arc.Path)
+			if out.Err != nil {
+				t.Fatal(out.Err)
+			}
+			if !slices.Contains(out.Checks, tt.algorithm) {
+				t.Errorf("checks are %v, want %s among them", out.Checks, tt.algorithm)
+			}
+		})
+	}
+}
+
+func TestDigestMatches(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		digest    string
+		stored    string
+		want      bool
+	}{
+		{hashCRC32, "12abcd", "12abcd", true},
+		{hashCRC32, "12abcd", "0012abcd", true},
+		{hashCRC32, "12abcd", "0012ABCD", true},
+		{hashCRC32, "12abcd", "12ab", true},
+		{hashCRC32, "12abcd", "0012", false},
+		{hashCRC32, "12abcd", "0012abce", false},
+		{hashCRC32, "12abcd", "not-hex", false},
+		{hashSHA256, "00abcd", "abcd", false},
+		{hashSHA256, "00abcd", "00ab", true},
+	}
+	for _, tt := range tests {
+		if got := digestMatches(tt.algorithm, tt.digest, tt.stored); got != tt.want {
+			t.Errorf("digestMatches(%s, %q, %q) = %v, want %v", tt.algorithm, tt.digest, tt.stored, got, tt.want)
+		}
+	}
+}
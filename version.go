@@ -0,0 +1,47 @@
+package main
+
+import (
+	"fmt"
+	"runtime/debug"
+)
+
+// version and commit identify the build. They can be set at build time with
+//
+//	go build -ldflags "-X main.version=1.2 -X main.commit=abc1234"
+//
+// and otherwise fall back to what the Go toolchain embedded in the binary.
+var (
+	version = ""
+	commit  = ""
+)
+
+// buildInfo returns the tool's version and build commit.
+func buildInfo() (string, string) {
+	v, c := version, commit
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if v == "" && info.Main.Version != "" && info.Main.Version != "(devel)" {
+			v = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if c == "" && setting.Key == "vcs.revision" {
+				c = setting.Value
+			}
+		}
+	}
+	if v == "" {
+		v = "dev"
+	}
+	return v, c
+}
+
+// versionString formats the build info for humans, e.g. "1.2 (abc1234)".
+func versionString() string {
+	v, c := buildInfo()
+	if c == "" {
+		return v
+	}
+	if len(c) > 12 {
+		c = c[:12]
+	}
+	return fmt.Sprintf("%s (%s)", v, c)
+}